@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+// batchSender returns the campaign's provider as a BatchSender and how many
+// jobs to claim per call, or nil when batching is off (-batch-size <= 1) or
+// the provider has no bulk API.
+func (c *Controller) batchSender(ctx context.Context, campaignID string) (BatchSender, int) {
+	if c.batchSize <= 1 {
+		return nil, 0
+	}
+	provider, err := c.campaignProvider(ctx, campaignID)
+	if err != nil {
+		return nil, 0
+	}
+	bs, ok := provider.(BatchSender)
+	if !ok {
+		return nil, 0
+	}
+	n := c.batchSize
+	if max := bs.MaxBatch(); max > 0 && n > max {
+		n = max
+	}
+	return bs, n
+}
+
+// claimMore tops up a claimed job with up to n-1 more that are queued right
+// now; it never waits for a batch to fill.
+func (c *Controller) claimMore(ctx context.Context, campaignID, workerID, first string, n int) []string {
+	raws := []string{first}
+	for len(raws) < n {
+		raw, err := c.store.PopToProcessing(ctx, campaignID, workerID, c.visibility, 0)
+		if err != nil || raw == "" {
+			break
+		}
+		raws = append(raws, raw)
+	}
+	return raws
+}
+
+// handleBatch is handleJob for a batch: each job is rate limited and rendered
+// on its own, the messages go to the provider in one SendBatch, and each
+// per-message result is acked, retried or failed exactly as a single send
+// would be.
+func (c *Controller) handleBatch(ctx context.Context, campaignID, workerID string, bs BatchSender, raws []string) {
+	release := c.holdLeases(campaignID, workerID, raws...)
+	defer release()
+
+	var (
+		jobs  []JobPayload
+		msgs  []*Message
+		ready []string
+	)
+	for _, raw := range raws {
+		job, msg, ok := c.prepareJob(ctx, campaignID, workerID, raw)
+		if ctx.Err() != nil {
+			return // stopping: the leases expire and the reconciler requeues the jobs
+		}
+		if ok {
+			jobs, msgs, ready = append(jobs, job), append(msgs, msg), append(ready, raw)
+		}
+	}
+	if len(msgs) == 0 {
+		return
+	}
+
+	errs := bs.SendBatch(ctx, msgs)
+	if ctx.Err() != nil {
+		return // interrupted by StopCampaign, not a provider failure
+	}
+	if len(errs) != len(msgs) {
+		fmt.Printf("[%s] %s returned %d results for %d messages\n", workerID, bs.Name(), len(errs), len(msgs))
+	}
+	var sent int64
+	by := map[string]int64{}
+	var delivered []Delivery
+	for i, raw := range ready {
+		var err error
+		if i < len(errs) {
+			err = errs[i]
+		} else {
+			err = &ProviderError{Provider: bs.Name(), Class: ErrClassTransient, Message: "no result for message"}
+		}
+		if err != nil {
+			c.handleSendError(ctx, campaignID, workerID, jobs[i], err)
+		} else {
+			name := deliveredBy(msgs[i], bs)
+			sent++
+			by[name]++
+			delivered = append(delivered, jobs[i].delivered(name))
+		}
+		_ = c.store.RemoveFromProcessing(ctx, campaignID, raw)
+	}
+	if sent > 0 {
+		_, _ = c.store.IncrProgress(ctx, campaignID, "sent", sent)
+	}
+	for name, n := range by {
+		_, _ = c.store.IncrProgress(ctx, campaignID, "sent:"+name, n)
+	}
+	if len(delivered) > 0 {
+		_ = c.store.RecordDeliveries(ctx, campaignID, delivered)
+	}
+}
@@ -0,0 +1,471 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Campaign states. The status key in the store is the source of truth; a
+// campaign that has never been defined reads as "" and behaves like draft.
+const (
+	StateDraft     = "draft"
+	StateReady     = "ready"
+	StateRunning   = "running"
+	StatePaused    = "paused"
+	StateCompleted = "completed"
+	StateCancelled = "cancelled"
+	StateFailed    = "failed"
+)
+
+// draft → ready → running ↔ paused → completed/cancelled/failed
+var transitions = map[string][]string{
+	StateDraft:   {StateReady, StateCancelled},
+	StateReady:   {StateDraft, StateRunning, StateCancelled},
+	StateRunning: {StatePaused, StateCompleted, StateCancelled, StateFailed},
+	StatePaused:  {StateRunning, StateCancelled, StateFailed},
+}
+
+var (
+	ErrIllegalTransition = errors.New("illegal state transition")
+	ErrCampaignExists    = errors.New("campaign already exists")
+	ErrCampaignNotFound  = errors.New("campaign not found")
+	ErrInvalidCampaign   = errors.New("invalid campaign")
+)
+
+func isTerminal(state string) bool {
+	return state == StateCompleted || state == StateCancelled || state == StateFailed
+}
+
+// sourcesFor lists every state that may move to `to`. "" stands in for draft.
+func sourcesFor(to string) []string {
+	var from []string
+	for s, next := range transitions {
+		for _, n := range next {
+			if n != to {
+				continue
+			}
+			from = append(from, s)
+			if s == StateDraft {
+				from = append(from, "")
+			}
+		}
+	}
+	return from
+}
+
+// Schedule is an optional start (and hard stop) time for a campaign.
+type Schedule struct {
+	StartAt *time.Time `json:"start_at,omitempty"`
+	StopAt  *time.Time `json:"stop_at,omitempty"`
+}
+
+// CampaignDef is the persisted campaign metadata.
+type CampaignDef struct {
+	ID            string         `json:"id"`
+	Name          string         `json:"name"`
+	Owner         string         `json:"owner,omitempty"`
+	Schedule      *Schedule      `json:"schedule,omitempty"`
+	SendWindow    *SendWindow    `json:"send_window,omitempty"`
+	LocalDelivery *LocalDelivery `json:"local_delivery,omitempty"` // applied at upload time
+	RetryPolicy   *RetryPolicy   `json:"retry_policy,omitempty"`
+	Provider      string         `json:"provider,omitempty"` // registered provider name; "" = the default
+	CreatedAt     time.Time      `json:"created_at"`
+	UpdatedAt     time.Time      `json:"updated_at"`
+}
+
+// Campaign is the API view: the stored definition plus the settings that live
+// under their own keys (sender in the message, template, rate limit, status).
+type Campaign struct {
+	CampaignDef
+	Sender    *Address  `json:"sender,omitempty"`
+	Template  *Template `json:"template,omitempty"`
+	RateLimit int64     `json:"rate_limit,omitempty"` // TPM
+	State     string    `json:"state"`
+}
+
+// CampaignPatch carries the fields a PATCH may change; nil means unchanged.
+type CampaignPatch struct {
+	Name          *string        `json:"name"`
+	Owner         *string        `json:"owner"`
+	Sender        *Address       `json:"sender"`
+	Template      *Template      `json:"template"`
+	RateLimit     *int64         `json:"rate_limit"`
+	Schedule      *Schedule      `json:"schedule"`
+	SendWindow    *SendWindow    `json:"send_window"`    // {} clears
+	LocalDelivery *LocalDelivery `json:"local_delivery"` // {} clears
+	RetryPolicy   *RetryPolicy   `json:"retry_policy"`   // {} restores the defaults
+	Provider      *string        `json:"provider"`       // "" = the default provider
+	State         *string        `json:"state"`
+}
+
+func newID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Transition moves a campaign to `to` if the state machine allows it from
+// whatever state it is in right now (checked atomically in the store).
+func (c *Controller) Transition(ctx context.Context, campaignID, to string) error {
+	ok, cur, err := c.store.TransitionStatus(ctx, campaignID, sourcesFor(to), to)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		if cur == "" {
+			cur = StateDraft
+		}
+		return fmt.Errorf("%w: %s -> %s", ErrIllegalTransition, cur, to)
+	}
+	return nil
+}
+
+func (c *Controller) CreateCampaign(ctx context.Context, in *Campaign) (*Campaign, error) {
+	if in.ID == "" {
+		in.ID = newID()
+	}
+	if in.Template != nil {
+		if _, err := in.Template.Compile(); err != nil {
+			return nil, fmt.Errorf("%w: template: %v", ErrInvalidCampaign, err)
+		}
+	}
+	if err := in.Schedule.Validate(); err != nil {
+		return nil, err
+	}
+	if err := in.SendWindow.Validate(); err != nil {
+		return nil, err
+	}
+	if err := in.LocalDelivery.Validate(); err != nil {
+		return nil, err
+	}
+	if err := in.RetryPolicy.Validate(); err != nil {
+		return nil, err
+	}
+	if err := c.validProvider(in.Provider); err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	in.CreatedAt, in.UpdatedAt = now, now
+	created, err := c.store.CreateCampaignDef(ctx, &in.CampaignDef)
+	if err != nil {
+		return nil, err
+	}
+	if !created {
+		return nil, ErrCampaignExists
+	}
+	c.store.RegisterCampaign(ctx, in.ID)
+	if err := c.store.SetStatus(ctx, in.ID, StateDraft); err != nil {
+		return nil, err
+	}
+	if err := c.applySettings(ctx, in.ID, in.Sender, in.Template, in.RateLimit); err != nil {
+		return nil, err
+	}
+	if in.Schedule != nil {
+		if err := c.scheduleCampaign(ctx, in.ID, in.Schedule); err != nil {
+			return nil, err
+		}
+	}
+	return c.GetCampaign(ctx, in.ID)
+}
+
+func (c *Controller) GetCampaign(ctx context.Context, campaignID string) (*Campaign, error) {
+	def, err := c.store.GetCampaignDef(ctx, campaignID)
+	if err != nil {
+		return nil, err
+	}
+	if def == nil {
+		return nil, ErrCampaignNotFound
+	}
+	out := &Campaign{CampaignDef: *def}
+	if out.State, err = c.store.GetStatus(ctx, campaignID); err != nil && !isNotFound(err) {
+		return nil, err
+	}
+	if out.State == "" {
+		out.State = StateDraft
+	}
+	if msg, err := c.store.GetMessage(ctx, campaignID); err != nil {
+		return nil, err
+	} else if msg != nil && msg.From.Email != "" {
+		out.Sender = &msg.From
+	}
+	raw, err := c.store.GetTemplate(ctx, campaignID)
+	if err != nil {
+		return nil, err
+	}
+	if raw != "" {
+		out.Template = &Template{}
+		if err := json.Unmarshal([]byte(raw), out.Template); err != nil {
+			return nil, err
+		}
+	}
+	if out.RateLimit, err = c.store.GetRateLimit(ctx, campaignID); err != nil && !isNotFound(err) {
+		return nil, err
+	}
+	return out, nil
+}
+
+// UpdateCampaign applies a PATCH. Terminal campaigns are read-only.
+func (c *Controller) UpdateCampaign(ctx context.Context, campaignID string, p *CampaignPatch) (*Campaign, error) {
+	cur, err := c.GetCampaign(ctx, campaignID)
+	if err != nil {
+		return nil, err
+	}
+	if isTerminal(cur.State) {
+		return nil, fmt.Errorf("%w: campaign is %s", ErrIllegalTransition, cur.State)
+	}
+	if p.Template != nil {
+		if _, err := p.Template.Compile(); err != nil {
+			return nil, fmt.Errorf("%w: template: %v", ErrInvalidCampaign, err)
+		}
+	}
+	if err := p.Schedule.Validate(); err != nil {
+		return nil, err
+	}
+	if p.SendWindow != nil && (p.SendWindow.Start != "" || p.SendWindow.End != "") {
+		if err := p.SendWindow.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	if p.LocalDelivery != nil && p.LocalDelivery.Time != "" {
+		if err := p.LocalDelivery.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	if err := p.RetryPolicy.Validate(); err != nil {
+		return nil, err
+	}
+	if p.Provider != nil {
+		if err := c.validProvider(*p.Provider); err != nil {
+			return nil, err
+		}
+	}
+	if p.State != nil {
+		switch *p.State {
+		case StateDraft, StateReady, StateRunning, StatePaused, StateCancelled:
+		case StateCompleted, StateFailed:
+			return nil, fmt.Errorf("%w: %s is set by the system", ErrIllegalTransition, *p.State)
+		default:
+			return nil, fmt.Errorf("%w: unknown state %q", ErrInvalidCampaign, *p.State)
+		}
+	}
+
+	def := cur.CampaignDef
+	if p.Name != nil {
+		def.Name = *p.Name
+	}
+	if p.Owner != nil {
+		def.Owner = *p.Owner
+	}
+	if p.Schedule != nil {
+		def.Schedule = p.Schedule
+	}
+	if p.SendWindow != nil {
+		def.SendWindow = p.SendWindow
+		if p.SendWindow.Start == "" && p.SendWindow.End == "" {
+			def.SendWindow = nil
+		}
+	}
+	if p.LocalDelivery != nil {
+		def.LocalDelivery = p.LocalDelivery
+		if p.LocalDelivery.Time == "" {
+			def.LocalDelivery = nil
+		}
+	}
+	if p.RetryPolicy != nil {
+		def.RetryPolicy = p.RetryPolicy
+		if p.RetryPolicy.isZero() {
+			def.RetryPolicy = nil
+		}
+	}
+	if p.Provider != nil {
+		def.Provider = *p.Provider
+	}
+	def.UpdatedAt = time.Now().UTC()
+	if err := c.store.SaveCampaignDef(ctx, &def); err != nil {
+		return nil, err
+	}
+	c.forgetDef(campaignID)
+	if p.Schedule != nil {
+		if err := c.scheduleCampaign(ctx, campaignID, p.Schedule); err != nil {
+			return nil, err
+		}
+	}
+	var limit int64
+	if p.RateLimit != nil {
+		limit = *p.RateLimit
+	}
+	if err := c.applySettings(ctx, campaignID, p.Sender, p.Template, limit); err != nil {
+		return nil, err
+	}
+	if p.State != nil && *p.State != cur.State {
+		if err := c.setState(ctx, campaignID, *p.State); err != nil {
+			return nil, err
+		}
+	}
+	return c.GetCampaign(ctx, campaignID)
+}
+
+// setState applies a PATCHed state the way the control endpoints would:
+// running starts the worker pool and cancelled drains the queue like /cancel.
+func (c *Controller) setState(ctx context.Context, campaignID, to string) error {
+	switch to {
+	case StateRunning:
+		if err := c.Transition(ctx, campaignID, StateRunning); err != nil {
+			return err
+		}
+		c.StartCampaign(campaignID) // no-op if this process already runs the pool
+		return nil
+	case StateCancelled:
+		_, err := c.CancelCampaign(ctx, campaignID, false)
+		return err
+	default:
+		return c.Transition(ctx, campaignID, to)
+	}
+}
+
+// ResumeCampaign restarts a paused campaign. Unlike start it accepts no other
+// state, so a ready campaign is never started by /resume.
+func (c *Controller) ResumeCampaign(ctx context.Context, campaignID string) error {
+	ok, cur, err := c.store.TransitionStatus(ctx, campaignID, []string{StatePaused}, StateRunning)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		if cur == "" {
+			cur = StateDraft
+		}
+		return fmt.Errorf("%w: %s -> %s", ErrIllegalTransition, cur, StateRunning)
+	}
+	c.StartCampaign(campaignID) // no-op if this process already runs the pool
+	return nil
+}
+
+// DeleteCampaign removes a campaign and all of its data. Campaigns with live
+// workers (running or paused) must be cancelled first.
+func (c *Controller) DeleteCampaign(ctx context.Context, campaignID string) error {
+	cur, err := c.GetCampaign(ctx, campaignID)
+	if err != nil {
+		return err
+	}
+	if cur.State == StateRunning || cur.State == StatePaused {
+		return fmt.Errorf("%w: campaign is %s", ErrIllegalTransition, cur.State)
+	}
+	c.mu.Lock()
+	delete(c.templates, campaignID)
+	c.mu.Unlock()
+	c.forgetDef(campaignID)
+	return c.store.DeleteCampaign(ctx, campaignID)
+}
+
+func (c *Controller) ListCampaigns(ctx context.Context) ([]*Campaign, error) {
+	ids, err := c.store.ListCampaigns(ctx)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]*Campaign, 0, len(ids))
+	for _, id := range ids {
+		cp, err := c.GetCampaign(ctx, id)
+		if errors.Is(err, ErrCampaignNotFound) {
+			continue // started without a definition
+		}
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, cp)
+	}
+	return out, nil
+}
+
+// applySettings writes the parts of a campaign kept under their own keys.
+// Zero values leave the current setting alone.
+func (c *Controller) applySettings(ctx context.Context, campaignID string, sender *Address, tpl *Template, tpm int64) error {
+	if sender != nil {
+		msg, err := c.store.GetMessage(ctx, campaignID)
+		if err != nil {
+			return err
+		}
+		if msg == nil {
+			msg = &Message{}
+		}
+		msg.From = *sender
+		if err := c.store.SetMessage(ctx, campaignID, msg); err != nil {
+			return err
+		}
+	}
+	if tpl != nil {
+		if err := c.store.SetTemplate(ctx, campaignID, tpl); err != nil {
+			return err
+		}
+	}
+	if tpm > 0 {
+		if err := c.store.SetRateLimit(ctx, campaignID, tpm); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// defCacheTTL bounds how stale a worker's view of a definition can be.
+const defCacheTTL = 5 * time.Second
+
+type cachedDef struct {
+	def *CampaignDef
+	at  time.Time
+}
+
+// campaignDef returns the stored definition (nil if none), cached briefly so
+// workers do not hit the store for it on every job.
+func (c *Controller) campaignDef(ctx context.Context, campaignID string) (*CampaignDef, error) {
+	c.mu.Lock()
+	cached, ok := c.defs[campaignID]
+	c.mu.Unlock()
+	if ok && time.Since(cached.at) < defCacheTTL {
+		return cached.def, nil
+	}
+	def, err := c.store.GetCampaignDef(ctx, campaignID)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	c.defs[campaignID] = cachedDef{def: def, at: time.Now()}
+	c.mu.Unlock()
+	return def, nil
+}
+
+func (c *Controller) forgetDef(campaignID string) {
+	c.mu.Lock()
+	delete(c.defs, campaignID)
+	c.mu.Unlock()
+}
+
+func (c *Controller) validProvider(name string) error {
+	if _, ok := c.providers.Get(name); name != "" && !ok {
+		return fmt.Errorf("%w: provider %q is not configured (have %s)", ErrInvalidCampaign, name, strings.Join(c.providers.Names(), ", "))
+	}
+	return nil
+}
+
+// providerName is the name of the provider the campaign sends through.
+func (c *Controller) providerName(ctx context.Context, campaignID string) string {
+	if def, _ := c.campaignDef(ctx, campaignID); def != nil && def.Provider != "" {
+		return def.Provider
+	}
+	return c.providers.DefaultName()
+}
+
+// campaignProvider returns the campaign's provider. A campaign whose provider
+// is no longer configured (e.g. after a restart with different credentials)
+// gets an auth-class error, which pauses it instead of silently switching ESP.
+func (c *Controller) campaignProvider(ctx context.Context, campaignID string) (EmailProvider, error) {
+	name := c.providerName(ctx, campaignID)
+	if p, ok := c.providers.Get(name); ok {
+		return p, nil
+	}
+	return nil, &ProviderError{Provider: name, Class: ErrClassAuth, Message: "provider is not configured"}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+const (
+	EventCancelled = "campaign.cancelled"
+
+	drainBatch = 500
+
+	// exportTimeout bounds one export. Jobs held for more than twice that
+	// belong to an export that died, and the next export takes them over.
+	exportTimeout = time.Hour
+)
+
+type CancelResult struct {
+	Cancelled int64  `json:"cancelled"`            // recipients removed without being sent
+	ExportKey string `json:"export_key,omitempty"` // S3 key of the unsent-recipient CSV
+}
+
+// CancelCampaign aborts a campaign: it stops workers, drains the queue,
+// processing list and retry ZSET into the "cancelled" progress counter and,
+// if export is set, streams the unsent recipients to S3 as a CSV that can be
+// uploaded again later. Calling it on an already cancelled campaign just
+// drains whatever is left.
+func (c *Controller) CancelCampaign(ctx context.Context, campaignID string, export bool) (*CancelResult, error) {
+	if err := c.Transition(ctx, campaignID, StateCancelled); err != nil {
+		status, _ := c.store.GetStatus(ctx, campaignID)
+		if !errors.Is(err, ErrIllegalTransition) || status != StateCancelled {
+			return nil, err
+		}
+	}
+	c.StopCampaign(campaignID)
+
+	res := &CancelResult{}
+	var err error
+	if export {
+		res.ExportKey = fmt.Sprintf("campaigns/%s/cancelled_%d.csv", campaignID, time.Now().Unix())
+		res.Cancelled, err = c.drainToS3(ctx, campaignID, res.ExportKey)
+	} else {
+		res.Cancelled, err = c.drain(ctx, campaignID, "", nil)
+	}
+	if res.Cancelled > 0 {
+		if _, ierr := c.store.IncrProgress(ctx, campaignID, "cancelled", res.Cancelled); ierr != nil && err == nil {
+			err = ierr
+		}
+	}
+	if err != nil {
+		return res, err
+	}
+	c.emit(ctx, EventCancelled, campaignID)
+	return res, nil
+}
+
+// drain removes pending jobs batch by batch, handing each batch to fn. With
+// fn set the jobs are only held aside under token, and the caller must
+// ReleaseHeld them.
+func (c *Controller) drain(ctx context.Context, campaignID, token string, fn func([]JobPayload) error) (int64, error) {
+	take := c.store.DrainPending
+	if fn != nil {
+		take = func(ctx context.Context, campaignID string, max int) ([]string, error) {
+			return c.store.HoldPending(ctx, campaignID, token, max)
+		}
+	}
+	var n int64
+	for {
+		items, err := take(ctx, campaignID, drainBatch)
+		if err != nil {
+			return n, err
+		}
+		n += int64(len(items))
+		if fn != nil && len(items) > 0 {
+			jobs := make([]JobPayload, 0, len(items))
+			for _, raw := range items {
+				var job JobPayload
+				if json.Unmarshal([]byte(raw), &job) == nil {
+					jobs = append(jobs, job)
+				}
+			}
+			if err := fn(jobs); err != nil {
+				return n, err
+			}
+		}
+		if len(items) < drainBatch {
+			return n, nil
+		}
+	}
+}
+
+// drainToS3 streams drained recipients through a pipe into a multipart
+// upload, so memory stays bounded however many recipients are left. The jobs
+// are only held while uploading, under a token of this export's own: they
+// are deleted once S3 has the whole file, and put back on the queue if the
+// upload fails, so a retried cancel can export them again.
+func (c *Controller) drainToS3(ctx context.Context, campaignID, key string) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, exportTimeout)
+	defer cancel()
+	columns, err := c.store.GetColumns(ctx, campaignID)
+	if err != nil {
+		return 0, err
+	}
+	// jobs held by an export that died before finishing go out with this
+	// one; holds of exports still running elsewhere are left alone
+	now := time.Now()
+	if err := c.releaseStaleHolds(ctx, campaignID, now.Add(-2*exportTimeout)); err != nil {
+		return 0, err
+	}
+	token := holdToken(now)
+
+	pr, pw := io.Pipe()
+	uploaded := make(chan error, 1)
+	go func() {
+		_, err := manager.NewUploader(c.s3Cli).Upload(ctx, &s3.PutObjectInput{
+			Bucket:      aws.String(getenv("S3_BUCKET", "my-bucket")),
+			Key:         aws.String(key),
+			Body:        pr,
+			ContentType: aws.String("text/csv"),
+		})
+		_ = pr.CloseWithError(err) // unblock the writer if the upload failed
+		uploaded <- err
+	}()
+
+	w := csv.NewWriter(pw)
+	headerDone := false
+	n, err := c.drain(ctx, campaignID, token, func(jobs []JobPayload) error {
+		for _, job := range jobs {
+			if !headerDone {
+				if columns == nil {
+					// no header recorded at ingestion: use the first row's fields
+					columns = append([]string{"email"}, sortedKeys(job.Fields)...)
+				}
+				if err := w.Write(columns); err != nil {
+					return err
+				}
+				headerDone = true
+			}
+			row := make([]string, len(columns))
+			for i, col := range columns {
+				if i == 0 {
+					row[i] = job.Email
+				} else {
+					row[i] = job.Fields[col]
+				}
+			}
+			if err := w.Write(row); err != nil {
+				return err
+			}
+		}
+		w.Flush()
+		return w.Error()
+	})
+	_ = pw.CloseWithError(err)
+	if uerr := <-uploaded; uerr != nil && err == nil {
+		err = fmt.Errorf("export upload: %w", uerr)
+	}
+	// the request may be gone by now; the held jobs still have to be settled
+	bg := context.Background()
+	if err != nil {
+		if _, rerr := c.store.ReleaseHeld(bg, campaignID, token, true); rerr != nil {
+			return 0, fmt.Errorf("%w (requeueing drained jobs: %v)", err, rerr)
+		}
+		return 0, err
+	}
+	if _, err := c.store.ReleaseHeld(bg, campaignID, token, false); err != nil {
+		return n, err
+	}
+	return n, nil
+}
+
+// holdToken names the jobs one export holds. It starts with the time the
+// export began, so releaseStaleHolds can tell abandoned holds apart.
+func holdToken(started time.Time) string {
+	return strconv.FormatInt(started.UnixMilli(), 10) + "-" + newID()
+}
+
+// releaseStaleHolds requeues the jobs of every export that began before
+// cutoff. Tokens that do not parse count as stale.
+func (c *Controller) releaseStaleHolds(ctx context.Context, campaignID string, cutoff time.Time) error {
+	tokens, err := c.store.HeldTokens(ctx, campaignID)
+	if err != nil {
+		return err
+	}
+	for _, token := range tokens {
+		ms, _ := strconv.ParseInt(strings.SplitN(token, "-", 2)[0], 10, 64)
+		if time.UnixMilli(ms).Before(cutoff) {
+			if _, err := c.store.ReleaseHeld(ctx, campaignID, token, true); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
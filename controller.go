@@ -1,26 +1,34 @@
 package main
 
 import (
+	"bufio"
 	"context"
-	"encoding/csv"
-	"io"
-	"strings"
-	"time"
-	"os"
+	"fmt"
 	"log"
+	"os"
+	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
-    "github.com/aws/aws-sdk-go-v2/config"
-    "github.com/aws/aws-sdk-go-v2/credentials"
-    "github.com/aws/aws-sdk-go-v2/service/s3"
-	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types" 
-    "github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
 )
 
 type Controller struct {
-	store    *RedisQueueStore
-	provider EmailProvider
-	workers  int
+	store     QueueStore
+	providers *ProviderRegistry
+	workers   int
+	batchSize int // jobs per provider call for BatchSenders; <= 1 sends one by one
+
+	instanceID string        // identifies this process in lease owners
+	visibility time.Duration // lease length for in-flight jobs
+
+	mu        sync.Mutex
+	templates map[string]*compiledTemplate // compiled per campaign
+	pools     map[string]*workerPool       // running worker pools per campaign
+	defs      map[string]cachedDef         // short-lived definition cache for workers
 
 	awsCfg aws.Config
 	s3Cli  *s3.Client
@@ -28,60 +36,91 @@ type Controller struct {
 }
 
 func EnsureBucket(ctx context.Context, s3Cli *s3.Client, bucket string) {
-    _, err := s3Cli.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: aws.String(bucket)})
-    if err != nil {
-        _, err = s3Cli.CreateBucket(ctx, &s3.CreateBucketInput{
-            Bucket: aws.String(bucket),
-        })
-        if err != nil {
-            log.Fatalf("failed to create bucket: %v", err)
-        }
-        log.Printf("Created bucket: %s", bucket)
-    }
+	_, err := s3Cli.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: aws.String(bucket)})
+	if err != nil {
+		_, err = s3Cli.CreateBucket(ctx, &s3.CreateBucketInput{
+			Bucket: aws.String(bucket),
+		})
+		if err != nil {
+			log.Fatalf("failed to create bucket: %v", err)
+		}
+		log.Printf("Created bucket: %s", bucket)
+	}
 }
 
+// LoadAWSConfig builds the aws.Config shared by the S3 client and the SES
+// provider. AWS_ENDPOINT points every AWS client at one endpoint (e.g.
+// LocalStack); S3_ENDPOINT and SES_ENDPOINT override it per service.
+func LoadAWSConfig() aws.Config {
+	region := os.Getenv("AWS_REGION")
+	accessKey := os.Getenv("AWS_ACCESS_KEY_ID")
+	secretKey := os.Getenv("AWS_SECRET_ACCESS_KEY")
 
-func NewS3Client() *s3.Client {
-    endpoint := os.Getenv("S3_ENDPOINT")
-    region := os.Getenv("AWS_REGION")
-    accessKey := os.Getenv("AWS_ACCESS_KEY_ID")
-    secretKey := os.Getenv("AWS_SECRET_ACCESS_KEY")
-
-    cfg, err := config.LoadDefaultConfig(context.TODO(),
-        config.WithRegion(region),
-        config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(accessKey, secretKey, "")),
-    )
-    if err != nil {
-        log.Fatalf("failed to load AWS config: %v", err)
-    }
+	opts := []func(*config.LoadOptions) error{config.WithRegion(region)}
+	if accessKey != "" {
+		opts = append(opts, config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(accessKey, secretKey, "")))
+	}
+	cfg, err := config.LoadDefaultConfig(context.TODO(), opts...)
+	if err != nil {
+		log.Fatalf("failed to load AWS config: %v", err)
+	}
 
-    if endpoint != "" {
-        cfg.BaseEndpoint = aws.String(endpoint)
-    }
+	if endpoint := os.Getenv("AWS_ENDPOINT"); endpoint != "" {
+		cfg.BaseEndpoint = aws.String(endpoint)
+	}
+	return cfg
+}
 
+func NewS3Client(cfg aws.Config) *s3.Client {
+	endpoint := os.Getenv("S3_ENDPOINT")
 
-    return s3.NewFromConfig(cfg, func(o *s3.Options) {
-        o.UsePathStyle = true // Required for MinIO or local S3
-    })
+	return s3.NewFromConfig(cfg, func(o *s3.Options) {
+		if endpoint != "" {
+			o.BaseEndpoint = aws.String(endpoint)
+		}
+		o.UsePathStyle = true // Required for MinIO or local S3
+	})
 }
 
 func NewS3Presigner(cli *s3.Client) *s3.PresignClient {
-    public := os.Getenv("S3_PUBLIC_ENDPOINT")
-    if public == "" {
-        public = "http://localhost:9000" 
-    }
+	public := os.Getenv("S3_PUBLIC_ENDPOINT")
+	if public == "" {
+		public = "http://localhost:9000"
+	}
 
-    return s3.NewPresignClient(cli, func(po *s3.PresignOptions) {
-        po.ClientOptions = append(po.ClientOptions, func(o *s3.Options) {
-            o.BaseEndpoint = aws.String(public)
-            o.UsePathStyle = true
-        })
-    })
+	return s3.NewPresignClient(cli, func(po *s3.PresignOptions) {
+		po.ClientOptions = append(po.ClientOptions, func(o *s3.Options) {
+			o.BaseEndpoint = aws.String(public)
+			o.UsePathStyle = true
+		})
+	})
 }
 
+func NewController(store QueueStore, providers *ProviderRegistry, workers int) *Controller {
+	c := &Controller{
+		store:     store,
+		providers: providers,
+		workers:   workers,
+
+		instanceID: instanceID(),
+		visibility: time.Minute,
 
-func NewController(store *RedisQueueStore, provider EmailProvider, workers int) *Controller {
-	return &Controller{store: store, provider: provider, workers: workers}
+		templates: map[string]*compiledTemplate{},
+		pools:     map[string]*workerPool{},
+		defs:      map[string]cachedDef{},
+	}
+	// failover routes answer to their own provider limits
+	for _, name := range providers.Names() {
+		if f, ok := providers.providers[name].(*FailoverProvider); ok {
+			f.takeRate = c.takeProviderRate
+		}
+	}
+	return c
+}
+
+func instanceID() string {
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s-%d", host, os.Getpid())
 }
 
 func (c *Controller) SetAWSConfig(cfg aws.Config) {
@@ -90,12 +129,88 @@ func (c *Controller) SetAWSConfig(cfg aws.Config) {
 	c.ps = s3.NewPresignClient(c.s3Cli)
 }
 
-func (c *Controller) StartCampaign(id string) {
-	// stateless; safe to call multiple times
+// workerPool is the set of worker goroutines this process runs for one campaign.
+type workerPool struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{} // closed once every worker has returned
+}
+
+// StartCampaign starts this process's worker pool for the campaign. It is a
+// no-op (returning false) if a pool is already running, so repeated /start or
+// /resume calls never multiply concurrency. A pool that is still shutting
+// down does not count: a fresh one replaces it.
+func (c *Controller) StartCampaign(id string) bool {
 	c.store.RegisterCampaign(context.Background(), id)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if p, ok := c.pools[id]; ok && p.ctx.Err() == nil {
+		return false
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	pool := &workerPool{ctx: ctx, cancel: cancel, done: make(chan struct{})}
+	c.pools[id] = pool
+
+	var wg sync.WaitGroup
 	for i := 0; i < c.workers; i++ {
-		go c.workerLoop(id, i)
+		wg.Add(1)
+		go func(wid int) {
+			defer wg.Done()
+			c.workerLoop(ctx, id, wid)
+		}(i)
+	}
+	// workers also exit on their own once the campaign reaches a terminal
+	// state; deregister the pool either way
+	go func() {
+		wg.Wait()
+		cancel()
+		c.mu.Lock()
+		if c.pools[id] == pool {
+			delete(c.pools, id)
+		}
+		c.mu.Unlock()
+		close(pool.done)
+	}()
+	return true
+}
+
+// StopCampaign cancels the campaign's worker pool and waits for in-flight
+// jobs to return. Jobs interrupted mid-send keep their lease and are
+// requeued by the reconciler once it expires.
+func (c *Controller) StopCampaign(id string) {
+	c.mu.Lock()
+	pool, ok := c.pools[id]
+	c.mu.Unlock()
+	if !ok {
+		return
+	}
+	pool.cancel()
+	<-pool.done
+}
+
+// PoolRunning reports whether this process runs workers for the campaign.
+func (c *Controller) PoolRunning(id string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.pools[id]
+	return ok
+}
+
+// RestoreWorkers restarts pools for campaigns left running or paused when
+// the process last stopped.
+func (c *Controller) RestoreWorkers(ctx context.Context) error {
+	ids, err := c.store.ListCampaigns(ctx)
+	if err != nil {
+		return err
 	}
+	for _, id := range ids {
+		status, _ := c.store.GetStatus(ctx, id)
+		if status == StateRunning || status == StatePaused {
+			c.StartCampaign(id)
+		}
+	}
+	return nil
 }
 
 // ---- S3 multipart presign helpers ----
@@ -164,38 +279,21 @@ func (c *Controller) S3AbortMultipart(ctx context.Context, key, uploadID string)
 }
 
 // Parse the CSV (from S3) and enqueue jobs (one per email).
-// For simplicity & to fix your compile error, this version downloads into memory
-// via manager.NewWriteAtBuffer. (You can switch to a streaming approach later.)
+// The GetObject body is read as a stream, so memory use does not grow with
+// the size of the recipient list.
 func (c *Controller) ParseS3CSVAndEnqueue(s3Key, campaignID string) error {
 	bucket := getenv("S3_BUCKET", "my-bucket")
-	downloader := manager.NewDownloader(c.s3Cli)
+	ctx := context.Background()
 
-	buf := manager.NewWriteAtBuffer([]byte{})
-	_, err := downloader.Download(context.Background(), buf, &s3.GetObjectInput{
+	out, err := c.s3Cli.GetObject(ctx, &s3.GetObjectInput{
 		Bucket: aws.String(bucket),
 		Key:    aws.String(s3Key),
 	})
 	if err != nil {
 		return err
 	}
+	defer out.Body.Close()
 
-	reader := csv.NewReader(strings.NewReader(string(buf.Bytes())))
-	var total int64
-	for {
-		rec, err := reader.Read()
-		if err == io.EOF {
-			break
-		}
-		if err != nil || len(rec) == 0 {
-			continue
-		}
-		email := strings.TrimSpace(rec[0])
-		if email == "" {
-			continue
-		}
-		_ = c.store.Enqueue(context.Background(), campaignID, JobPayload{Email: email, Attempts: 0})
-		total++
-	}
-	_ = c.store.InitProgress(context.Background(), campaignID, total)
-	return nil
+	_, err = c.IngestCSV(ctx, campaignID, bufio.NewReaderSize(out.Body, 1<<20))
+	return err
 }
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+// DeadLetterPage is one page of a campaign's dead-letter list.
+type DeadLetterPage struct {
+	Total  int64        `json:"total"`
+	Offset int          `json:"offset"`
+	Items  []JobPayload `json:"items"`
+}
+
+// deadLetter parks a job that will not be retried and counts it as failed.
+// The payload keeps its attempt history and last error for inspection.
+func (c *Controller) deadLetter(ctx context.Context, campaignID string, job JobPayload) {
+	if job.ID == "" {
+		job.ID = newID() // jobs enqueued before IDs existed
+	}
+	if err := c.store.AddDeadLetter(ctx, campaignID, job.ID, mustJSON(job), time.Now()); err != nil {
+		fmt.Printf("dead letter %s/%s: %v\n", campaignID, job.ID, err)
+	}
+	_, _ = c.store.IncrProgress(ctx, campaignID, "failed", 1)
+}
+
+// DeadLetters returns up to limit dead letters starting at offset, oldest first.
+func (c *Controller) DeadLetters(ctx context.Context, campaignID string, offset, limit int) (*DeadLetterPage, error) {
+	if _, err := c.store.GetStatus(ctx, campaignID); isNotFound(err) {
+		return nil, ErrCampaignNotFound
+	}
+	raws, total, err := c.store.DeadLetters(ctx, campaignID, offset, limit)
+	if err != nil {
+		return nil, err
+	}
+	page := &DeadLetterPage{Total: total, Offset: offset, Items: make([]JobPayload, 0, len(raws))}
+	for _, raw := range raws {
+		var job JobPayload
+		if json.Unmarshal([]byte(raw), &job) == nil {
+			page.Items = append(page.Items, job)
+		}
+	}
+	return page, nil
+}
+
+// WriteDeadLettersCSV streams every dead letter as CSV: the recipient columns
+// from ingestion followed by attempts and last_error.
+func (c *Controller) WriteDeadLettersCSV(ctx context.Context, campaignID string, out io.Writer) error {
+	if _, err := c.store.GetStatus(ctx, campaignID); isNotFound(err) {
+		return ErrCampaignNotFound
+	}
+	columns, err := c.store.GetColumns(ctx, campaignID)
+	if err != nil {
+		return err
+	}
+	if columns == nil {
+		columns = []string{"email"}
+	}
+	w := csv.NewWriter(out)
+	if err := w.Write(append(append([]string(nil), columns...), "attempts", "last_error")); err != nil {
+		return err
+	}
+	for offset := 0; ; offset += drainBatch {
+		raws, _, err := c.store.DeadLetters(ctx, campaignID, offset, drainBatch)
+		if err != nil {
+			return err
+		}
+		for _, raw := range raws {
+			var job JobPayload
+			if json.Unmarshal([]byte(raw), &job) != nil {
+				continue
+			}
+			row := make([]string, 0, len(columns)+2)
+			for i, col := range columns {
+				if i == 0 {
+					row = append(row, job.Email)
+				} else {
+					row = append(row, job.Fields[col])
+				}
+			}
+			row = append(row, strconv.Itoa(job.Attempts), job.LastError)
+			if err := w.Write(row); err != nil {
+				return err
+			}
+		}
+		w.Flush()
+		if err := w.Error(); err != nil {
+			return err
+		}
+		if len(raws) < drainBatch {
+			return nil
+		}
+	}
+}
+
+// ReplayDeadLetters puts the given dead letters (all of them when jobIDs is
+// empty) back in the queue with a fresh attempt budget; their history is kept.
+// They stop counting as failed, and a completed campaign is reopened so the
+// replayed jobs get sent. Cancelled and failed campaigns cannot be replayed.
+func (c *Controller) ReplayDeadLetters(ctx context.Context, campaignID string, jobIDs []string) (int64, error) {
+	status, err := c.store.GetStatus(ctx, campaignID)
+	if isNotFound(err) {
+		return 0, ErrCampaignNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+	if status == StateCancelled || status == StateFailed {
+		return 0, fmt.Errorf("%w: cannot replay into a %s campaign", ErrIllegalTransition, status)
+	}
+
+	var n int64
+	for {
+		raws, err := c.store.TakeDeadLetters(ctx, campaignID, jobIDs, drainBatch)
+		if err != nil {
+			return n, err
+		}
+		jobs := make([]any, 0, len(raws))
+		for _, raw := range raws {
+			var job JobPayload
+			if json.Unmarshal([]byte(raw), &job) != nil {
+				continue
+			}
+			job.Attempts, job.NextRetryAt = 0, nil
+			jobs = append(jobs, job)
+		}
+		if err := c.store.EnqueueBatch(ctx, campaignID, jobs); err != nil {
+			return n, err
+		}
+		if len(jobs) > 0 {
+			if _, err := c.store.IncrProgress(ctx, campaignID, "failed", -int64(len(jobs))); err != nil {
+				return n, err
+			}
+		}
+		n += int64(len(jobs))
+		if len(jobIDs) > 0 || len(raws) < drainBatch {
+			break
+		}
+	}
+
+	if n > 0 {
+		// Reopen a completed campaign with the same targeted swap
+		// ResumeCampaign uses; anything else keeps its state.
+		ok, _, err := c.store.TransitionStatus(ctx, campaignID, []string{StateCompleted}, StateRunning)
+		if err != nil {
+			return n, err
+		}
+		if ok {
+			if err := c.store.DeleteProgress(ctx, campaignID, "finished_at"); err != nil {
+				return n, err
+			}
+			c.StartCampaign(campaignID)
+		}
+	}
+	return n, nil
+}
@@ -2,59 +2,380 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
-	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 )
 
 type EmailProvider interface {
-	Send(email string) error
+	// Name identifies the provider account (used for per-provider rate limits).
+	Name() string
+	// Send delivers one message. Failures the provider can explain come back
+	// as *ProviderError so the worker knows whether to retry, back off,
+	// dead-letter or pause.
+	Send(ctx context.Context, msg *Message) error
+}
+
+// BatchSender is implemented by providers with a bulk API. SendBatch sends up
+// to MaxBatch messages in as few calls as it can and returns one result per
+// message, in order (nil = accepted).
+type BatchSender interface {
+	EmailProvider
+	MaxBatch() int
+	SendBatch(ctx context.Context, msgs []*Message) []error
+}
+
+// ProviderRegistry holds every configured provider by name. A campaign picks
+// one with "provider"; campaigns that don't pick one use the default, which is
+// the first one registered unless SetDefault says otherwise.
+type ProviderRegistry struct {
+	providers map[string]EmailProvider
+	def       string
+}
+
+func NewProviderRegistry() *ProviderRegistry {
+	return &ProviderRegistry{providers: map[string]EmailProvider{}}
+}
+
+func (r *ProviderRegistry) Register(p EmailProvider) {
+	if r.def == "" {
+		r.def = p.Name()
+	}
+	r.providers[p.Name()] = p
+}
+
+func (r *ProviderRegistry) SetDefault(name string) error {
+	if _, ok := r.providers[name]; !ok {
+		return fmt.Errorf("provider %q is not configured", name)
+	}
+	r.def = name
+	return nil
+}
+
+// Get returns the named provider; "" means the default.
+func (r *ProviderRegistry) Get(name string) (EmailProvider, bool) {
+	if name == "" {
+		name = r.def
+	}
+	p, ok := r.providers[name]
+	return p, ok
+}
+
+func (r *ProviderRegistry) DefaultName() string { return r.def }
+
+// Close releases what providers hold open between sends (pooled SMTP
+// connections).
+func (r *ProviderRegistry) Close() {
+	for _, p := range r.providers {
+		if c, ok := p.(interface{ Close() }); ok {
+			c.Close()
+		}
+	}
+}
+
+func (r *ProviderRegistry) Names() []string {
+	names := make([]string, 0, len(r.providers))
+	for n := range r.providers {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
 }
 
 type MockProvider struct{}
 
 func NewMockProvider() *MockProvider { return &MockProvider{} }
-func (m *MockProvider) Send(email string) error {
-	if strings.TrimSpace(email) == "" { return errors.New("empty email") }
+func (m *MockProvider) Name() string { return "mock" }
+func (m *MockProvider) Send(ctx context.Context, msg *Message) error {
+	if err := msg.Validate(); err != nil {
+		return permanentError(m.Name(), err)
+	}
 	// simulate success quickly
 	return nil
 }
 
-// Minimal SendGrid example (replace payload as you wish)
+// SendGrid v3 mail/send provider
 type SendGridProvider struct {
-	apiKey string
-	client *http.Client
+	apiKey  string
+	baseURL string // https://api.sendgrid.com, or a local stub
+	client  *http.Client
 }
 
-func NewSendGridProvider(apiKey string) *SendGridProvider {
+func NewSendGridProvider(apiKey, baseURL string) *SendGridProvider {
+	if baseURL == "" {
+		baseURL = "https://api.sendgrid.com"
+	}
 	return &SendGridProvider{
-		apiKey: apiKey,
-		client: &http.Client{Timeout: 10 * time.Second},
+		apiKey:  apiKey,
+		baseURL: strings.TrimRight(baseURL, "/"),
+		client:  &http.Client{Timeout: 10 * time.Second},
 	}
 }
 
-func (s *SendGridProvider) Send(email string) error {
-	if strings.TrimSpace(email) == "" { return errors.New("empty email") }
+func (s *SendGridProvider) Name() string { return "sendgrid" }
 
-	payload := map[string]any{
-		"personalizations": []map[string]any{{"to": []map[string]string{{"email": email}}}},
-		"from":    map[string]string{"email": "no-reply@example.com"},
-		"subject": "Campaign test email",
-		"content": []map[string]string{{"type": "text/plain", "value": "Hello from campaign!"}},
+func (s *SendGridProvider) Send(ctx context.Context, msg *Message) error {
+	if err := msg.Validate(); err != nil {
+		return permanentError(s.Name(), err)
 	}
+
+	_, err := s.post(ctx, sendGridPayload(msg))
+	return err
+}
+
+// post sends one mail/send request. On a refusal it also returns the response
+// body, which names the offending fields.
+func (s *SendGridProvider) post(ctx context.Context, payload map[string]any) ([]byte, error) {
 	b, _ := json.Marshal(payload)
-	req, _ := http.NewRequest("POST", "https://api.sendgrid.com/v3/mail/send", bytes.NewReader(b))
+	req, err := http.NewRequestWithContext(ctx, "POST", s.baseURL+"/v3/mail/send", bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
 	req.Header.Set("Authorization", "Bearer "+s.apiKey)
 	req.Header.Set("Content-Type", "application/json")
 
 	resp, err := s.client.Do(req)
-	if err != nil { return err }
+	if err != nil {
+		return nil, err
+	}
 	defer resp.Body.Close()
 	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil, nil
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	return body, httpError(s.Name(), resp)
+}
+
+// sendGridPayload maps a Message onto the v3 mail/send body.
+func sendGridPayload(msg *Message) map[string]any {
+	p := sendGridPersonalization(msg)
+
+	// text/plain must precede text/html
+	var content []map[string]string
+	if msg.Text != "" {
+		content = append(content, map[string]string{"type": "text/plain", "value": msg.Text})
+	}
+	if msg.HTML != "" {
+		content = append(content, map[string]string{"type": "text/html", "value": msg.HTML})
+	}
+
+	payload := map[string]any{
+		"personalizations": []map[string]any{p},
+		"from":             sendGridAddr(msg.From),
+		"subject":          msg.Subject,
+		"content":          content,
+	}
+	if msg.ReplyTo != nil {
+		payload["reply_to"] = sendGridAddr(*msg.ReplyTo)
+	}
+	if len(msg.Headers) > 0 {
+		payload["headers"] = msg.Headers
+	}
+	if len(msg.Attachments) > 0 {
+		atts := make([]map[string]string, 0, len(msg.Attachments))
+		for _, a := range msg.Attachments {
+			att := map[string]string{
+				"filename": a.Filename,
+				"content":  base64.StdEncoding.EncodeToString(a.Content),
+			}
+			if a.ContentType != "" {
+				att["type"] = a.ContentType
+			}
+			if a.ContentID != "" {
+				att["disposition"] = "inline"
+				att["content_id"] = a.ContentID
+			}
+			atts = append(atts, att)
+		}
+		payload["attachments"] = atts
+	}
+	return payload
+}
+
+// sendGridPersonalization is the per-recipient part of a mail/send body.
+func sendGridPersonalization(msg *Message) map[string]any {
+	p := map[string]any{"to": sendGridAddrs(msg.To)}
+	if len(msg.Cc) > 0 {
+		p["cc"] = sendGridAddrs(msg.Cc)
+	}
+	if len(msg.Bcc) > 0 {
+		p["bcc"] = sendGridAddrs(msg.Bcc)
+	}
+	if len(msg.Tags) > 0 {
+		p["custom_args"] = msg.Tags
+	}
+	return p
+}
+
+func sendGridAddr(a Address) map[string]string {
+	m := map[string]string{"email": a.Email}
+	if a.Name != "" {
+		m["name"] = a.Name
+	}
+	return m
+}
+
+func sendGridAddrs(as []Address) []map[string]string {
+	out := make([]map[string]string, 0, len(as))
+	for _, a := range as {
+		out = append(out, sendGridAddr(a))
+	}
+	return out
+}
+
+const (
+	sendGridMaxPersonalizations = 1000
+	sendGridMaxSubstitutions    = 10000 // bytes per personalization, keys included
+	sendGridTextToken           = "-campaign-text-"
+	sendGridHTMLToken           = "-campaign-html-"
+)
+
+func (s *SendGridProvider) MaxBatch() int { return sendGridMaxPersonalizations }
+
+// SendBatch puts messages that share sender, reply-to and attachments into one
+// mail/send request, one personalization each carrying its own recipients,
+// subject, headers and tags. Bodies that differ per recipient travel as
+// substitutions; a message too big for those is sent on its own.
+func (s *SendGridProvider) SendBatch(ctx context.Context, msgs []*Message) []error {
+	errs := make([]error, len(msgs))
+	groups := map[string][]int{}
+	var keys []string
+	for i, msg := range msgs {
+		if err := msg.Validate(); err != nil {
+			errs[i] = permanentError(s.Name(), err)
+			continue
+		}
+		key := sendGridGroupKey(msg)
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], i)
+	}
+	for _, key := range keys {
+		s.sendGroup(ctx, msgs, groups[key], errs, true)
+	}
+	return errs
+}
+
+// sendGridGroupKey is equal for messages that can share one request.
+func sendGridGroupKey(msg *Message) string {
+	b, _ := json.Marshal([]any{msg.From, msg.ReplyTo, msg.Text != "", msg.HTML != "", msg.Attachments})
+	sum := sha256.Sum256(b)
+	return string(sum[:])
+}
+
+// sendGroup sends msgs[idx] in one request and fills in errs. If SendGrid
+// refuses the request over particular personalizations, those fail and the
+// rest are sent again once without them.
+func (s *SendGridProvider) sendGroup(ctx context.Context, msgs []*Message, idx []int, errs []error, retry bool) {
+	first := msgs[idx[0]]
+	shared := true
+	for _, i := range idx[1:] {
+		if msgs[i].Text != first.Text || msgs[i].HTML != first.HTML {
+			shared = false
+			break
+		}
+	}
+	if !shared {
+		var fits []int
+		for _, i := range idx {
+			if len(msgs[i].Text)+len(msgs[i].HTML)+len(sendGridTextToken)+len(sendGridHTMLToken) > sendGridMaxSubstitutions {
+				errs[i] = s.Send(ctx, msgs[i])
+			} else {
+				fits = append(fits, i)
+			}
+		}
+		if idx = fits; len(idx) == 0 {
+			return
+		}
+	}
+
+	payload := sendGridPayload(first)
+	delete(payload, "headers") // per personalization below
+	ps := make([]map[string]any, 0, len(idx))
+	for _, i := range idx {
+		msg := msgs[i]
+		p := sendGridPersonalization(msg)
+		p["subject"] = msg.Subject
+		if len(msg.Headers) > 0 {
+			p["headers"] = msg.Headers
+		}
+		if !shared {
+			subs := map[string]string{}
+			if msg.Text != "" {
+				subs[sendGridTextToken] = msg.Text
+			}
+			if msg.HTML != "" {
+				subs[sendGridHTMLToken] = msg.HTML
+			}
+			p["substitutions"] = subs
+		}
+		ps = append(ps, p)
+	}
+	payload["personalizations"] = ps
+	if !shared {
+		var content []map[string]string
+		if first.Text != "" {
+			content = append(content, map[string]string{"type": "text/plain", "value": sendGridTextToken})
+		}
+		if first.HTML != "" {
+			content = append(content, map[string]string{"type": "text/html", "value": sendGridHTMLToken})
+		}
+		payload["content"] = content
+	}
+
+	body, err := s.post(ctx, payload)
+	if err == nil {
+		return
+	}
+	if bad := sendGridBadPersonalizations(body); retry && len(bad) > 0 && len(bad) < len(idx) {
+		var rest []int
+		for n, i := range idx {
+			if bad[n] {
+				errs[i] = err
+			} else {
+				rest = append(rest, i)
+			}
+		}
+		s.sendGroup(ctx, msgs, rest, errs, false)
+		return
+	}
+	for _, i := range idx {
+		errs[i] = err
+	}
+}
+
+// sendGridBadPersonalizations reads which personalizations a 400 response
+// blames, from error fields like "personalizations.3.to.0.email".
+func sendGridBadPersonalizations(body []byte) map[int]bool {
+	var parsed struct {
+		Errors []struct {
+			Field string `json:"field"`
+		} `json:"errors"`
+	}
+	if json.Unmarshal(body, &parsed) != nil {
 		return nil
 	}
-	return fmt.Errorf("sendgrid status=%d", resp.StatusCode)
+	bad := map[int]bool{}
+	for _, e := range parsed.Errors {
+		rest, ok := strings.CutPrefix(e.Field, "personalizations.")
+		if !ok {
+			return nil // something about the whole request
+		}
+		n, err := strconv.Atoi(strings.SplitN(rest, ".", 2)[0])
+		if err != nil {
+			return nil
+		}
+		bad[n] = true
+	}
+	return bad
 }
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSendGridBadPersonalizations(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want map[int]bool
+	}{
+		{"per recipient", `{"errors":[{"field":"personalizations.3.to.0.email"},{"field":"personalizations.7.to"}]}`, map[int]bool{3: true, 7: true}},
+		{"whole request", `{"errors":[{"field":"personalizations.1.to"},{"field":"from.email"}]}`, nil},
+		{"no field", `{"errors":[{"message":"bad"}]}`, nil},
+		{"bad index", `{"errors":[{"field":"personalizations.x.to"}]}`, nil},
+		{"not json", `oops`, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sendGridBadPersonalizations([]byte(tt.body)); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
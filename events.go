@@ -0,0 +1,31 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// Campaign lifecycle events, published on the store's event channel
+// (Redis pub/sub "campaigns:events") for anything that wants to react.
+const (
+	EventCompleted = "campaign.completed"
+	EventPaused    = "campaign.paused" // by a worker, after the provider rejected our credentials
+)
+
+type CampaignEvent struct {
+	Type       string            `json:"type"`
+	CampaignID string            `json:"campaign_id"`
+	At         time.Time         `json:"at"`
+	Progress   map[string]string `json:"progress,omitempty"`
+}
+
+// emit publishes an event; failures are logged, never fatal.
+func (c *Controller) emit(ctx context.Context, typ, campaignID string) {
+	ev := CampaignEvent{Type: typ, CampaignID: campaignID, At: time.Now().UTC()}
+	ev.Progress, _ = c.store.GetProgress(ctx, campaignID)
+	log.Printf("event %s campaign=%s progress=%v", ev.Type, ev.CampaignID, ev.Progress)
+	if err := c.store.PublishEvent(ctx, ev); err != nil {
+		log.Printf("publish event %s: %v", ev.Type, err)
+	}
+}
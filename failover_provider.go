@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FailoverRoute is one provider behind a FailoverProvider.
+type FailoverRoute struct {
+	Provider EmailProvider
+	Weight   int // share of first attempts; 0 = standby, only used to fail over
+}
+
+// FailoverProvider spreads sends across several providers by weight and fails
+// over to the next one when a provider is down. Every route has a circuit
+// breaker: after enough consecutive failures the route is skipped for a
+// cooldown, then a single trial send decides whether it comes back.
+//
+// Only failures that say nothing about the message itself fail over
+// (timeouts, network and 5xx errors, throttling, bad credentials). A
+// permanent rejection is returned as is: the next provider would refuse the
+// same message.
+//
+// A route whose provider-account limit (provider:<name>) has no slot left is
+// skipped too, so one account hitting its limit moves sends to the others.
+type FailoverProvider struct {
+	name   string
+	routes []*failoverRoute
+	// takeRate spends one send from a provider's own limit; set by
+	// NewController. nil means routes are not rate limited.
+	takeRate func(ctx context.Context, provider string) (bool, time.Duration, error)
+}
+
+type failoverRoute struct {
+	FailoverRoute
+	breaker *circuitBreaker
+}
+
+func NewFailoverProvider(name string, routes []FailoverRoute, failures int, cooldown time.Duration) *FailoverProvider {
+	if failures <= 0 {
+		failures = 5
+	}
+	if cooldown <= 0 {
+		cooldown = 30 * time.Second
+	}
+	f := &FailoverProvider{name: name}
+	for _, r := range routes {
+		f.routes = append(f.routes, &failoverRoute{FailoverRoute: r, breaker: &circuitBreaker{threshold: failures, cooldown: cooldown}})
+	}
+	return f
+}
+
+// parseFailoverRoutes reads "sendgrid:3,postmark:1,smtp:0" (weight defaults
+// to 1) against the providers already registered.
+func parseFailoverRoutes(spec string, providers *ProviderRegistry) ([]FailoverRoute, error) {
+	var routes []FailoverRoute
+	seen := map[string]bool{}
+	for _, item := range strings.Split(spec, ",") {
+		name, weight, hasWeight := strings.Cut(strings.TrimSpace(item), ":")
+		route := FailoverRoute{Weight: 1}
+		if hasWeight {
+			w, err := strconv.Atoi(strings.TrimSpace(weight))
+			if err != nil || w < 0 {
+				return nil, fmt.Errorf("bad weight in %q", item)
+			}
+			route.Weight = w
+		}
+		p, ok := providers.Get(name)
+		if name == "" || !ok {
+			return nil, fmt.Errorf("provider %q is not configured", name)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("provider %q listed twice", name)
+		}
+		seen[name] = true
+		route.Provider = p
+		routes = append(routes, route)
+	}
+	total := 0
+	for _, r := range routes {
+		total += r.Weight
+	}
+	if total == 0 {
+		return nil, fmt.Errorf("at least one provider needs a weight above 0")
+	}
+	return routes, nil
+}
+
+func (f *FailoverProvider) Name() string { return f.name }
+
+// Send tries the routes in weighted-random order, skipping those whose
+// breaker is open. On success msg.DeliveredBy names the provider that took it.
+func (f *FailoverProvider) Send(ctx context.Context, msg *Message) error {
+	var firstRetryable, lastErr error
+	var limitedFor time.Duration // shortest wait for a rate-limited route
+	for _, r := range f.order() {
+		if !r.breaker.allow() {
+			continue
+		}
+		if f.takeRate != nil {
+			ok, wait, err := f.takeRate(ctx, r.Provider.Name())
+			if err != nil {
+				r.breaker.abort()
+				return err
+			}
+			if !ok {
+				r.breaker.abort()
+				if limitedFor == 0 || wait < limitedFor {
+					limitedFor = wait
+				}
+				continue
+			}
+		}
+		err := r.Provider.Send(ctx, msg)
+		if err == nil {
+			if r.breaker.success() {
+				fmt.Printf("[%s] %s circuit closed\n", f.name, r.Provider.Name())
+			}
+			if msg.DeliveredBy == "" {
+				msg.DeliveredBy = r.Provider.Name()
+			}
+			return nil
+		}
+		if ctx.Err() != nil {
+			r.breaker.abort()
+			return err
+		}
+		if !failsOver(err) {
+			// the provider is up; it just refused this message
+			if r.breaker.success() {
+				fmt.Printf("[%s] %s circuit closed\n", f.name, r.Provider.Name())
+			}
+			return err
+		}
+		if r.breaker.failure() {
+			fmt.Printf("[%s] %s circuit open for %s: %v\n", f.name, r.Provider.Name(), r.breaker.cooldown, err)
+		}
+		if firstRetryable == nil && errorClass(err) != ErrClassAuth {
+			firstRetryable = err
+		}
+		lastErr = err
+	}
+	switch {
+	case firstRetryable != nil:
+		// a retry may find a provider back up; don't pause on one bad account
+		return firstRetryable
+	case lastErr != nil:
+		return lastErr
+	case limitedFor > 0:
+		if wait := f.nextTrial(); wait > 0 && wait < limitedFor {
+			limitedFor = wait
+		}
+		return &ProviderError{Provider: f.name, Class: ErrClassThrottled, RetryAfter: limitedFor,
+			Message: "every available provider is at its rate limit"}
+	default:
+		wait := f.nextTrial()
+		return &ProviderError{Provider: f.name, Class: ErrClassThrottled, RetryAfter: wait,
+			Message: "every provider's circuit breaker is open"}
+	}
+}
+
+// failsOver reports whether err is the provider's problem rather than the
+// message's.
+func failsOver(err error) bool { return errorClass(err) != ErrClassPermanent }
+
+// order is a weighted shuffle of the weighted routes, followed by the
+// standbys in configuration order.
+func (f *FailoverProvider) order() []*failoverRoute {
+	var weighted, standby []*failoverRoute
+	total := 0
+	for _, r := range f.routes {
+		if r.Weight > 0 {
+			weighted = append(weighted, r)
+			total += r.Weight
+		} else {
+			standby = append(standby, r)
+		}
+	}
+	out := make([]*failoverRoute, 0, len(f.routes))
+	for len(weighted) > 0 {
+		n := rand.Intn(total)
+		for i, r := range weighted {
+			if n -= r.Weight; n < 0 {
+				out = append(out, r)
+				total -= r.Weight
+				weighted = append(weighted[:i], weighted[i+1:]...)
+				break
+			}
+		}
+	}
+	return append(out, standby...)
+}
+
+// nextTrial is how long until the first open breaker lets a trial through.
+func (f *FailoverProvider) nextTrial() time.Duration {
+	var wait time.Duration
+	for _, r := range f.routes {
+		if w := r.breaker.retryIn(); w > 0 && (wait == 0 || w < wait) {
+			wait = w
+		}
+	}
+	return wait
+}
+
+// FailoverRouteStatus is one route as shown by GET /providers.
+type FailoverRouteStatus struct {
+	Provider string `json:"provider"`
+	Weight   int    `json:"weight"`
+	Circuit  string `json:"circuit"` // closed, open or half-open
+	Failures int    `json:"consecutive_failures"`
+}
+
+func (f *FailoverProvider) Routes() []FailoverRouteStatus {
+	out := make([]FailoverRouteStatus, 0, len(f.routes))
+	for _, r := range f.routes {
+		state, failures := r.breaker.state()
+		out = append(out, FailoverRouteStatus{Provider: r.Provider.Name(), Weight: r.Weight, Circuit: state, Failures: failures})
+	}
+	return out
+}
+
+// circuitBreaker opens after threshold consecutive failures. Once the
+// cooldown has passed it lets one trial call through (half-open): success
+// closes it, failure opens it for another cooldown.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	openUntil time.Time
+	trial     bool // a half-open trial call is in flight
+}
+
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures < b.threshold {
+		return true
+	}
+	if b.trial || time.Now().Before(b.openUntil) {
+		return false
+	}
+	b.trial = true
+	return true
+}
+
+// success resets the breaker and reports whether that closed an open circuit.
+func (b *circuitBreaker) success() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	wasOpen := b.failures >= b.threshold
+	b.failures, b.trial = 0, false
+	return wasOpen
+}
+
+// failure counts a failed call and reports whether it opened the circuit:
+// the threshold was just reached, or a half-open trial failed.
+func (b *circuitBreaker) failure() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	trial := b.trial
+	b.trial = false
+	if b.failures < b.threshold {
+		return false
+	}
+	b.openUntil = time.Now().Add(b.cooldown)
+	return b.failures == b.threshold || trial
+}
+
+// abort ends a call that was interrupted without telling us anything.
+func (b *circuitBreaker) abort() {
+	b.mu.Lock()
+	b.trial = false
+	b.mu.Unlock()
+}
+
+func (b *circuitBreaker) retryIn() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures < b.threshold {
+		return 0
+	}
+	return time.Until(b.openUntil)
+}
+
+func (b *circuitBreaker) state() (string, int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch {
+	case b.failures < b.threshold:
+		return "closed", b.failures
+	case b.trial || !time.Now().Before(b.openUntil):
+		return "half-open", b.failures
+	default:
+		return "open", b.failures
+	}
+}
+
+// deliveredBy names the provider that took msg: the one a FailoverProvider
+// picked, or else the campaign's provider itself.
+func deliveredBy(msg *Message, provider EmailProvider) string {
+	if msg.DeliveredBy != "" {
+		return msg.DeliveredBy
+	}
+	return provider.Name()
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// stubProvider counts sends and answers with err (nil = accepted).
+type stubProvider struct {
+	name  string
+	err   atomic.Value // *error; a nil error accepts the message
+	sends atomic.Int64
+}
+
+func newStubProvider(name string, err error) *stubProvider {
+	p := &stubProvider{name: name}
+	p.fail(err)
+	return p
+}
+
+func (p *stubProvider) fail(err error) { p.err.Store(&err) }
+
+func (p *stubProvider) Name() string { return p.name }
+
+func (p *stubProvider) Send(ctx context.Context, msg *Message) error {
+	p.sends.Add(1)
+	return *p.err.Load().(*error)
+}
+
+var errUnavailable = &ProviderError{Provider: "stub", Class: ErrClassTransient, StatusCode: 503}
+
+func TestFailoverProviderBreaker(t *testing.T) {
+	a, b := newStubProvider("a", errUnavailable), newStubProvider("b", nil)
+	f := NewFailoverProvider("failover", []FailoverRoute{{a, 1}, {b, 0}}, 3, 100*time.Millisecond)
+	for i := 0; i < 10; i++ {
+		msg := &Message{}
+		if err := f.Send(context.Background(), msg); err != nil || msg.DeliveredBy != "b" {
+			t.Fatalf("send %d: err=%v delivered by %q, want b", i, err, msg.DeliveredBy)
+		}
+	}
+	if n := a.sends.Load(); n != 3 {
+		t.Fatalf("a tried %d times, want 3 before its circuit opened", n)
+	}
+	if st := f.Routes()[0]; st.Circuit != "open" || st.Failures != 3 {
+		t.Fatalf("route a: %+v, want open after 3 failures", st)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	a.fail(nil)
+	msg := &Message{}
+	if err := f.Send(context.Background(), msg); err != nil || msg.DeliveredBy != "a" {
+		t.Fatalf("trial send: err=%v delivered by %q, want a", err, msg.DeliveredBy)
+	}
+	if st := f.Routes()[0]; st.Circuit != "closed" {
+		t.Fatalf("route a: %+v, want closed after a good trial", st)
+	}
+}
+
+func TestFailoverProviderWeights(t *testing.T) {
+	a, b := newStubProvider("a", nil), newStubProvider("b", nil)
+	f := NewFailoverProvider("failover", []FailoverRoute{{a, 3}, {b, 1}}, 0, 0)
+	for i := 0; i < 4000; i++ {
+		_ = f.Send(context.Background(), &Message{})
+	}
+	if share := float64(a.sends.Load()) / 4000; share < 0.7 || share > 0.8 {
+		t.Fatalf("a took %.2f of the sends, want about 0.75", share)
+	}
+}
+
+func TestFailoverProviderErrors(t *testing.T) {
+	t.Run("permanent does not fail over", func(t *testing.T) {
+		a := newStubProvider("a", &ProviderError{Provider: "a", Class: ErrClassPermanent, StatusCode: 400})
+		b := newStubProvider("b", nil)
+		f := NewFailoverProvider("failover", []FailoverRoute{{a, 1}, {b, 0}}, 1, time.Minute)
+		if err := f.Send(context.Background(), &Message{}); errorClass(err) != ErrClassPermanent || b.sends.Load() != 0 {
+			t.Fatalf("err=%v, b sent %d; want the permanent error and no failover", err, b.sends.Load())
+		}
+		if st := f.Routes()[0]; st.Circuit != "closed" {
+			t.Fatalf("a rejected message opened the circuit: %+v", st)
+		}
+	})
+
+	t.Run("retryable error preferred over auth", func(t *testing.T) {
+		a := newStubProvider("a", &ProviderError{Provider: "a", Class: ErrClassAuth, StatusCode: 401})
+		b := newStubProvider("b", errUnavailable)
+		f := NewFailoverProvider("failover", []FailoverRoute{{a, 1}, {b, 0}}, 5, time.Minute)
+		if err := f.Send(context.Background(), &Message{}); errorClass(err) != ErrClassTransient {
+			t.Fatalf("err=%v, want the transient error so the campaign is not paused", err)
+		}
+	})
+
+	t.Run("every circuit open", func(t *testing.T) {
+		f := NewFailoverProvider("failover", []FailoverRoute{{newStubProvider("a", errors.New("boom")), 1}}, 1, time.Minute)
+		_ = f.Send(context.Background(), &Message{})
+		var pe *ProviderError
+		if err := f.Send(context.Background(), &Message{}); !errors.As(err, &pe) || pe.Class != ErrClassThrottled || pe.RetryAfter <= 0 {
+			t.Fatalf("err=%v, want throttled with a Retry-After", err)
+		}
+	})
+}
+
+func TestFailoverProviderRateLimits(t *testing.T) {
+	store := NewMemoryQueueStore()
+	ctx := context.Background()
+	if err := store.SetScopedLimit(ctx, providerScope("a"), RateLimit{TPM: 60, Burst: 2}); err != nil {
+		t.Fatal(err)
+	}
+	a, b := newStubProvider("a", nil), newStubProvider("b", nil)
+	f := NewFailoverProvider("failover", []FailoverRoute{{a, 1}, {b, 0}}, 0, 0)
+	reg := NewProviderRegistry()
+	reg.Register(a)
+	reg.Register(b)
+	reg.Register(f)
+	NewController(store, reg, 1)
+
+	for i := 0; i < 5; i++ {
+		if err := f.Send(ctx, &Message{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if a.sends.Load() != 2 || b.sends.Load() != 3 {
+		t.Fatalf("a sent %d, b sent %d; want a held to its burst of 2", a.sends.Load(), b.sends.Load())
+	}
+
+	if err := store.SetScopedLimit(ctx, providerScope("b"), RateLimit{TPM: 60, Burst: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Send(ctx, &Message{}); err != nil || b.sends.Load() != 4 {
+		t.Fatalf("err=%v, b sent %d; want b's one slot used", err, b.sends.Load())
+	}
+	var pe *ProviderError
+	err := f.Send(ctx, &Message{})
+	if !errors.As(err, &pe) || pe.Class != ErrClassThrottled || pe.RetryAfter <= 0 || pe.RetryAfter > time.Second {
+		t.Fatalf("err=%v, want throttled until the next slot", err)
+	}
+}
+
+func TestParseFailoverRoutes(t *testing.T) {
+	reg := NewProviderRegistry()
+	reg.Register(newStubProvider("a", nil))
+	reg.Register(newStubProvider("b", nil))
+	routes, err := parseFailoverRoutes("a:2, b", reg)
+	if err != nil || len(routes) != 2 || routes[0].Weight != 2 || routes[1].Weight != 1 {
+		t.Fatalf("routes=%+v err=%v", routes, err)
+	}
+	for _, spec := range []string{"a:x", "a:-1", "z", "a,a", "a:0,b:0", ""} {
+		if _, err := parseFailoverRoutes(spec, reg); err == nil {
+			t.Errorf("%q accepted", spec)
+		}
+	}
+}
+
+func TestFailoverProviderDeliveryRecord(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryQueueStore()
+	a, b := newStubProvider("a", errUnavailable), newStubProvider("b", nil)
+	reg := NewProviderRegistry()
+	reg.Register(a)
+	reg.Register(b)
+	reg.Register(NewFailoverProvider("failover", []FailoverRoute{{a, 1}, {b, 0}}, 0, 0))
+	c := NewController(store, reg, 1)
+	camp, err := c.CreateCampaign(ctx, &Campaign{CampaignDef: CampaignDef{Name: "failover", Provider: "failover"},
+		Template: &Template{Subject: "s", Text: "t"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.IngestCSV(ctx, camp.ID, strings.NewReader("ann@x.com\n")); err != nil {
+		t.Fatal(err)
+	}
+	raw, job := mustPop(t, store, camp.ID, "w1", time.Minute)
+	c.handleJob(ctx, camp.ID, "w1", raw)
+
+	d, err := store.GetDelivery(ctx, camp.ID, "ann@x.com")
+	if err != nil || d.Provider != "b" || d.JobID != job.ID || d.At.IsZero() {
+		t.Fatalf("delivery %+v err=%v, want job %s delivered by b", d, err, job.ID)
+	}
+	if a.sends.Load() != 1 {
+		t.Fatalf("a tried %d times, want 1 before failing over", a.sends.Load())
+	}
+	if _, err := store.GetDelivery(ctx, camp.ID, "bob@x.com"); !isNotFound(err) {
+		t.Fatalf("undelivered recipient: err=%v, want not found", err)
+	}
+}
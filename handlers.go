@@ -1,12 +1,11 @@
 package main
 
 import (
-	"context"
-	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -17,24 +16,21 @@ func makeUploadHandler(c *Controller) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		id := mux.Vars(r)["id"]
 		if err := r.ParseMultipartForm(50 << 20); err != nil {
-			http.Error(w, "parse form: "+err.Error(), http.StatusBadRequest); return
+			http.Error(w, "parse form: "+err.Error(), http.StatusBadRequest)
+			return
 		}
 		f, _, err := r.FormFile("file")
-		if err != nil { http.Error(w, "file: "+err.Error(), http.StatusBadRequest); return }
+		if err != nil {
+			http.Error(w, "file: "+err.Error(), http.StatusBadRequest)
+			return
+		}
 		defer f.Close()
 
-		reader := csv.NewReader(f)
-		var total int64
-		for {
-			rec, err := reader.Read()
-			if err == io.EOF { break }
-			if err != nil || len(rec) == 0 { continue }
-			email := rec[0]
-			if email == "" { continue }
-			_ = c.store.Enqueue(context.Background(), id, JobPayload{Email: email, Attempts: 0})
-			total++
-		}
-		_ = c.store.InitProgress(context.Background(), id, total)
+		total, err := c.IngestCSV(r.Context(), id, f)
+		if err != nil {
+			http.Error(w, "ingest: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
 		w.WriteHeader(http.StatusAccepted)
 		_, _ = w.Write([]byte(fmt.Sprintf("enqueued=%d\n", total)))
 	}
@@ -59,14 +55,18 @@ func makeS3InitHandler(c *Controller) http.HandlerFunc {
 		campaignID := mux.Vars(r)["id"]
 		var req InitUploadRequest
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			http.Error(w, "bad json", http.StatusBadRequest); return
+			http.Error(w, "bad json", http.StatusBadRequest)
+			return
+		}
+		if req.Parts <= 0 {
+			req.Parts = 8
 		}
-		if req.Parts <= 0 { req.Parts = 8 }
 		key := fmt.Sprintf("campaigns/%s/%d_%s", campaignID, time.Now().Unix(), req.Filename)
 
 		uploadID, urls, err := c.S3CreateMultipartPresigns(r.Context(), key, req.Parts)
 		if err != nil {
-			http.Error(w, "init multipart: "+err.Error(), http.StatusInternalServerError); return
+			http.Error(w, "init multipart: "+err.Error(), http.StatusInternalServerError)
+			return
 		}
 		resp := InitUploadResponse{Key: key, UploadID: uploadID, URLs: urls, Parts: req.Parts}
 		w.Header().Set("Content-Type", "application/json")
@@ -86,10 +86,12 @@ func makeS3CompleteHandler(c *Controller) http.HandlerFunc {
 			} `json:"parts"`
 		}
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			http.Error(w, "bad json", http.StatusBadRequest); return
+			http.Error(w, "bad json", http.StatusBadRequest)
+			return
 		}
 		if err := c.S3CompleteMultipart(r.Context(), req.Key, req.UploadID, req.Parts); err != nil {
-			http.Error(w, "complete: "+err.Error(), http.StatusInternalServerError); return
+			http.Error(w, "complete: "+err.Error(), http.StatusInternalServerError)
+			return
 		}
 		// kick off CSV parse + enqueue (async)
 		go func() {
@@ -108,10 +110,12 @@ func makeS3AbortHandler(c *Controller) http.HandlerFunc {
 			UploadID string `json:"upload_id"`
 		}
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			http.Error(w, "bad json", http.StatusBadRequest); return
+			http.Error(w, "bad json", http.StatusBadRequest)
+			return
 		}
 		if err := c.S3AbortMultipart(r.Context(), req.Key, req.UploadID); err != nil {
-			http.Error(w, "abort: "+err.Error(), http.StatusInternalServerError); return
+			http.Error(w, "abort: "+err.Error(), http.StatusInternalServerError)
+			return
 		}
 		w.WriteHeader(http.StatusOK)
 	}
@@ -122,8 +126,11 @@ func makeS3AbortHandler(c *Controller) http.HandlerFunc {
 func makeStartHandler(c *Controller) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		id := mux.Vars(r)["id"]
-		_ = c.store.SetStatus(r.Context(), id, "running")
-		c.StartCampaign(id)
+		if err := c.Transition(r.Context(), id, StateRunning); err != nil {
+			campaignError(w, "start", err)
+			return
+		}
+		c.StartCampaign(id) // no-op if this process already runs the pool
 		w.WriteHeader(http.StatusOK)
 	}
 }
@@ -131,7 +138,10 @@ func makeStartHandler(c *Controller) http.HandlerFunc {
 func makePauseHandler(c *Controller) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		id := mux.Vars(r)["id"]
-		_ = c.store.SetStatus(r.Context(), id, "paused")
+		if err := c.Transition(r.Context(), id, StatePaused); err != nil {
+			campaignError(w, "pause", err)
+			return
+		}
 		w.WriteHeader(http.StatusOK)
 	}
 }
@@ -139,41 +149,433 @@ func makePauseHandler(c *Controller) http.HandlerFunc {
 func makeResumeHandler(c *Controller) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		id := mux.Vars(r)["id"]
-		_ = c.store.SetStatus(r.Context(), id, "running")
+		if err := c.ResumeCampaign(r.Context(), id); err != nil {
+			campaignError(w, "resume", err)
+			return
+		}
 		w.WriteHeader(http.StatusOK)
 	}
 }
 
+// POST { "export": true }   (body optional)
+func makeCancelHandler(c *Controller) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+		var req struct {
+			Export bool `json:"export"`
+		}
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "bad json", http.StatusBadRequest)
+				return
+			}
+		}
+		res, err := c.CancelCampaign(r.Context(), id, req.Export)
+		if err != nil {
+			campaignError(w, "cancel", err)
+			return
+		}
+		writeJSON(w, http.StatusOK, res)
+	}
+}
+
 func makeStatusHandler(c *Controller) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		id := mux.Vars(r)["id"]
 		p, _ := c.store.GetProgress(r.Context(), id)
 		status, _ := c.store.GetStatus(r.Context(), id)
-		limit, _ := c.store.GetRateLimit(r.Context(), id)
-		count, _ := c.store.GetRateCount(r.Context(), id)
+		limit := c.campaignRateLimit(r.Context(), id)
+		avail, _ := c.store.RateAvailable(r.Context(), campaignScope(id), limit)
+		used, _ := c.store.GetRateCount(r.Context(), id)
+		levels, _ := c.rateLimitStatus(r.Context(), id)
 		resp := map[string]any{
-			"id":      id,
-			"status":  status,
-			"progress": p,
-			"tpm_limit": limit,
-			"tpm_used":  count,
+			"id":            id,
+			"status":        status,
+			"progress":      p,
+			"tpm_limit":     limit.TPM,
+			"tpm_used":      used, // sends admitted in the current one-minute window
+			"tpm_burst":     limit.Burst,
+			"tpm_available": avail,
+			"rate_limits":   levels, // every level enforced on this campaign's sends
+			"local_workers": c.PoolRunning(id),
+		}
+		if cw, err := c.sendWindow(r.Context(), id); err != nil {
+			resp["in_send_window"] = false
+			resp["send_window_error"] = err.Error()
+		} else if cw != nil {
+			now := time.Now()
+			resp["in_send_window"] = cw.Contains(now)
+			if !cw.Contains(now) {
+				resp["next_window_at"] = cw.NextOpen(now).UTC()
+			}
 		}
 		w.Header().Set("Content-Type", "application/json")
 		_ = json.NewEncoder(w).Encode(resp)
 	}
 }
 
-// POST { "tpm": 200 }
+// POST { "tpm": 200, "burst": 20 }   (burst optional)
 func makeSetRateLimitHandler(c *Controller) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		id := mux.Vars(r)["id"]
-		var req struct{ TPM int64 `json:"tpm"` }
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.TPM <= 0 {
-			http.Error(w, "bad tpm", http.StatusBadRequest); return
+		var req RateLimit
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.TPM <= 0 || req.Burst < 0 {
+			http.Error(w, "bad tpm", http.StatusBadRequest)
+			return
 		}
 		if err := c.store.SetRateLimit(r.Context(), id, req.TPM); err != nil {
-			http.Error(w, "set limit: "+err.Error(), http.StatusInternalServerError); return
+			http.Error(w, "set limit: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if req.Burst > 0 {
+			if err := c.store.SetRateBurst(r.Context(), id, req.Burst); err != nil {
+				http.Error(w, "set burst: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// POST { "from": {...}, "subject": "...", "html": "...", ... }
+func makeSetMessageHandler(c *Controller) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+		var msg Message
+		if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+			http.Error(w, "bad json", http.StatusBadRequest)
+			return
+		}
+		if err := c.store.SetMessage(r.Context(), id, &msg); err != nil {
+			http.Error(w, "set message: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+func makeGetMessageHandler(c *Controller) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+		msg, err := c.campaignMessage(r.Context(), id)
+		if err != nil {
+			http.Error(w, "get message: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(msg)
+	}
+}
+
+// POST { "subject": "Hi {{.first_name}}", "html": "...", "text": "...", "missing_field": "fail|blank|default", "defaults": {...} }
+func makeSetTemplateHandler(c *Controller) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+		var t Template
+		if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+			http.Error(w, "bad json", http.StatusBadRequest)
+			return
+		}
+		if _, err := t.Compile(); err != nil {
+			http.Error(w, "template: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := c.store.SetTemplate(r.Context(), id, &t); err != nil {
+			http.Error(w, "set template: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// ---- Campaign definition CRUD ----
+
+// campaignError maps controller errors onto HTTP status codes.
+func campaignError(w http.ResponseWriter, op string, err error) {
+	switch {
+	case errors.Is(err, ErrCampaignNotFound):
+		http.Error(w, op+": "+err.Error(), http.StatusNotFound)
+	case errors.Is(err, ErrInvalidCampaign):
+		http.Error(w, op+": "+err.Error(), http.StatusBadRequest)
+	case errors.Is(err, ErrCampaignExists), errors.Is(err, ErrIllegalTransition):
+		http.Error(w, op+": "+err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, op+": "+err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// POST { "id": "c1", "name": "...", "owner": "...", "sender": {...}, "template": {...}, "rate_limit": 600, "schedule": {...} }
+func makeCreateCampaignHandler(c *Controller) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req Campaign
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "bad json", http.StatusBadRequest)
+			return
+		}
+		if req.Name == "" {
+			http.Error(w, "name required", http.StatusBadRequest)
+			return
+		}
+		cp, err := c.CreateCampaign(r.Context(), &req)
+		if err != nil {
+			campaignError(w, "create", err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, cp)
+	}
+}
+
+func makeListCampaignsHandler(c *Controller) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		list, err := c.ListCampaigns(r.Context())
+		if err != nil {
+			campaignError(w, "list", err)
+			return
+		}
+		writeJSON(w, http.StatusOK, list)
+	}
+}
+
+func makeGetCampaignHandler(c *Controller) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cp, err := c.GetCampaign(r.Context(), mux.Vars(r)["id"])
+		if err != nil {
+			campaignError(w, "get", err)
+			return
+		}
+		writeJSON(w, http.StatusOK, cp)
+	}
+}
+
+func makePatchCampaignHandler(c *Controller) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req CampaignPatch
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "bad json", http.StatusBadRequest)
+			return
+		}
+		cp, err := c.UpdateCampaign(r.Context(), mux.Vars(r)["id"], &req)
+		if err != nil {
+			campaignError(w, "update", err)
+			return
+		}
+		writeJSON(w, http.StatusOK, cp)
+	}
+}
+
+func makeDeleteCampaignHandler(c *Controller) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := c.DeleteCampaign(r.Context(), mux.Vars(r)["id"]); err != nil {
+			campaignError(w, "delete", err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// ---- Global / provider rate limits ----
+
+func makeListRateLimitsHandler(c *Controller) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limits, err := c.store.GetScopedLimits(r.Context())
+		if err != nil {
+			http.Error(w, "limits: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, limits)
+	}
+}
+
+func makeListProvidersHandler(c *Controller) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		resp := map[string]any{"default": c.providers.DefaultName(), "providers": c.providers.Names()}
+		// composite providers also show their routes and circuit breakers
+		routes := map[string][]FailoverRouteStatus{}
+		for _, name := range c.providers.Names() {
+			if p, _ := c.providers.Get(name); p != nil {
+				if f, ok := p.(*FailoverProvider); ok {
+					routes[name] = f.Routes()
+				}
+			}
+		}
+		if len(routes) > 0 {
+			resp["failover"] = routes
+		}
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
+
+// scopeFromRequest maps /rate-limits/global, /rate-limits/providers/{name} and
+// /rate-limits/domains/{domain} to a limiter scope.
+func scopeFromRequest(r *http.Request) string {
+	vars := mux.Vars(r)
+	if name := vars["name"]; name != "" {
+		return providerScope(name)
+	}
+	if domain := vars["domain"]; domain != "" {
+		return domainScope(domain)
+	}
+	return globalScope
+}
+
+// POST { "tpm": 6000, "burst": 100 }
+func makeSetScopedLimitHandler(c *Controller) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req RateLimit
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.TPM <= 0 || req.Burst < 0 {
+			http.Error(w, "bad tpm", http.StatusBadRequest)
+			return
+		}
+		if err := c.store.SetScopedLimit(r.Context(), scopeFromRequest(r), req.withDefaults()); err != nil {
+			http.Error(w, "set limit: "+err.Error(), http.StatusInternalServerError)
+			return
 		}
 		w.WriteHeader(http.StatusOK)
 	}
 }
+
+func makeDeleteScopedLimitHandler(c *Controller) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := c.store.DeleteScopedLimit(r.Context(), scopeFromRequest(r)); err != nil {
+			http.Error(w, "delete limit: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// POST { "start_at": "2026-11-01T09:00:00Z", "stop_at": "2026-11-01T21:00:00Z" }   (either optional; {} clears)
+func makeScheduleHandler(c *Controller) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+		var req Schedule
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "bad json", http.StatusBadRequest)
+			return
+		}
+		cp, err := c.UpdateCampaign(r.Context(), id, &CampaignPatch{Schedule: &req})
+		if err != nil {
+			campaignError(w, "schedule", err)
+			return
+		}
+		writeJSON(w, http.StatusOK, cp)
+	}
+}
+
+// ---- Dead letters + retries ----
+
+// pageParams reads ?offset=0&limit=100 (limit 1-1000).
+func pageParams(r *http.Request) (offset, limit int, err error) {
+	offset, limit = 0, 100
+	if v := r.URL.Query().Get("offset"); v != "" {
+		if offset, err = strconv.Atoi(v); err != nil || offset < 0 {
+			return 0, 0, errors.New("bad offset")
+		}
+	}
+	if v := r.URL.Query().Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit <= 0 || limit > 1000 {
+			return 0, 0, errors.New("bad limit (1-1000)")
+		}
+	}
+	return offset, limit, nil
+}
+
+// GET ?offset=0&limit=100
+func makeListDeadLettersHandler(c *Controller) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		offset, limit, err := pageParams(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		page, err := c.DeadLetters(r.Context(), mux.Vars(r)["id"], offset, limit)
+		if err != nil {
+			campaignError(w, "dead letters", err)
+			return
+		}
+		writeJSON(w, http.StatusOK, page)
+	}
+}
+
+func makeDownloadDeadLettersHandler(c *Controller) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+		if _, err := c.store.GetStatus(r.Context(), id); isNotFound(err) {
+			campaignError(w, "dead letters", ErrCampaignNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", id+"_dead_letters.csv"))
+		if err := c.WriteDeadLettersCSV(r.Context(), id, w); err != nil {
+			// headers are gone; all we can do is cut the download short
+			fmt.Printf("dead letter download %s: %v\n", id, err)
+		}
+	}
+}
+
+// POST { "ids": ["job1", "job2"] }  or  { "all": true }
+func makeReplayDeadLettersHandler(c *Controller) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			IDs []string `json:"ids"`
+			All bool     `json:"all"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "bad json", http.StatusBadRequest)
+			return
+		}
+		if len(req.IDs) == 0 && !req.All {
+			http.Error(w, "ids or all required", http.StatusBadRequest)
+			return
+		}
+		if req.All {
+			req.IDs = nil
+		}
+		n, err := c.ReplayDeadLetters(r.Context(), mux.Vars(r)["id"], req.IDs)
+		if err != nil {
+			campaignError(w, "replay", err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"replayed": n})
+	}
+}
+
+// GET ?offset=0&limit=100   recipients waiting for a retry, soonest first
+func makeListRetriesHandler(c *Controller) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		offset, limit, err := pageParams(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		page, err := c.Retries(r.Context(), mux.Vars(r)["id"], offset, limit)
+		if err != nil {
+			campaignError(w, "retries", err)
+			return
+		}
+		writeJSON(w, http.StatusOK, page)
+	}
+}
+
+// GET   which provider delivered the recipient's message, and when
+func makeGetDeliveryHandler(c *Controller) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		d, err := c.store.GetDelivery(r.Context(), vars["id"], vars["email"])
+		if isNotFound(err) {
+			http.Error(w, "not delivered", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			campaignError(w, "delivery", err)
+			return
+		}
+		writeJSON(w, http.StatusOK, d)
+	}
+}
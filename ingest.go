@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"io"
+	"strings"
+	"time"
+)
+
+// ingestBatchSize bounds how many parsed rows are held in memory before they
+// are flushed to the store in a single pipelined round trip.
+const ingestBatchSize = 500
+
+// IngestCSV streams recipients from r and enqueues them in batches, so memory
+// stays bounded by ingestBatchSize no matter how large the source is.
+// Malformed rows are skipped; read errors from the underlying stream abort.
+// Campaigns with local delivery get their jobs scheduled into the retry ZSET
+// at each recipient's local send time instead of the queue.
+func (c *Controller) IngestCSV(ctx context.Context, campaignID string, r io.Reader) (int64, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.ReuseRecord = true
+
+	def, err := c.store.GetCampaignDef(ctx, campaignID)
+	if err != nil {
+		return 0, err
+	}
+	var local *localScheduler
+	if def != nil && def.LocalDelivery != nil {
+		notBefore := time.Now()
+		if def.Schedule != nil && def.Schedule.StartAt != nil && def.Schedule.StartAt.After(notBefore) {
+			notBefore = *def.Schedule.StartAt
+		}
+		local = newLocalScheduler(def.LocalDelivery, notBefore)
+	}
+
+	batch := make([]any, 0, ingestBatchSize)
+	scheduled := make([]retryItem, 0)
+	var (
+		total    int64
+		header   []string // nil when the file has no header row
+		emailCol = 0
+		first    = true
+	)
+	flush := func() error {
+		if len(batch) > 0 {
+			if err := c.store.EnqueueBatch(ctx, campaignID, batch); err != nil {
+				return err
+			}
+			total += int64(len(batch))
+			batch = batch[:0]
+		}
+		if len(scheduled) > 0 {
+			if err := c.store.AddRetryBatch(ctx, campaignID, scheduled); err != nil {
+				return err
+			}
+			total += int64(len(scheduled))
+			scheduled = scheduled[:0]
+		}
+		return nil
+	}
+
+	for {
+		rec, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			var perr *csv.ParseError
+			if errors.As(err, &perr) {
+				continue
+			}
+			return total, err
+		}
+		if len(rec) == 0 {
+			continue
+		}
+		if first {
+			first = false
+			if h, col, ok := parseHeader(rec); ok {
+				header, emailCol = h, col
+				// remember the columns so unsent recipients can be exported in the same shape
+				if err := c.store.SetColumns(ctx, campaignID, exportColumns(header, emailCol)); err != nil {
+					return 0, err
+				}
+				continue
+			}
+			rec[0] = strings.TrimPrefix(rec[0], "\ufeff") // bare list: the BOM sits on the first address
+		}
+		if emailCol >= len(rec) {
+			continue
+		}
+		email := strings.TrimSpace(rec[emailCol])
+		if email == "" {
+			continue
+		}
+		job := JobPayload{ID: newID(), Email: email, Attempts: 0, Fields: rowFields(header, rec, emailCol)}
+		if local != nil {
+			scheduled = append(scheduled, retryItem{At: local.deliverAt(job.Fields).Unix(), Payload: mustJSON(job)})
+		} else {
+			batch = append(batch, job)
+		}
+		if len(batch)+len(scheduled) >= ingestBatchSize {
+			if err := flush(); err != nil {
+				return total, err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return total, err
+	}
+	if err := c.store.InitProgress(ctx, campaignID, total); err != nil {
+		return total, err
+	}
+	// recipients loaded: a draft campaign becomes startable
+	if err := c.Transition(ctx, campaignID, StateReady); err != nil && !errors.Is(err, ErrIllegalTransition) {
+		return total, err
+	}
+	return total, nil
+}
+
+// emailColumns are the header names recognised as the recipient column,
+// compared case-insensitively.
+var emailColumns = map[string]bool{"email": true, "e-mail": true, "email_address": true, "email address": true, "emailaddress": true}
+
+// parseHeader decides whether the first row is a header: it is one only if a
+// cell names the email column. Otherwise the file is a bare list with the
+// address in column 0, and the first row is a recipient like any other.
+func parseHeader(rec []string) ([]string, int, bool) {
+	header := make([]string, len(rec))
+	emailCol := -1
+	for i, name := range rec {
+		header[i] = strings.TrimSpace(strings.TrimPrefix(name, "\ufeff"))
+		if emailCol < 0 && emailColumns[strings.ToLower(header[i])] {
+			emailCol = i
+		}
+	}
+	if emailCol < 0 {
+		return nil, 0, false
+	}
+	return header, emailCol, true
+}
+
+// rowFields maps non-empty cells to their header names. Empty cells are left
+// out so the template missing-field policy applies to them.
+func rowFields(header, rec []string, emailCol int) map[string]string {
+	if header == nil {
+		return nil
+	}
+	var fields map[string]string
+	for i, v := range rec {
+		if i == emailCol || i >= len(header) || header[i] == "" {
+			continue
+		}
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+		if fields == nil {
+			fields = make(map[string]string, len(header)-1)
+		}
+		fields[header[i]] = v
+	}
+	return fields
+}
+
+// exportColumns is "email" followed by every other named header column.
+func exportColumns(header []string, emailCol int) []string {
+	cols := []string{"email"}
+	for i, h := range header {
+		if i != emailCol && h != "" {
+			cols = append(cols, h)
+		}
+	}
+	return cols
+}
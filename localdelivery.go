@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// LocalDelivery sends each recipient's email at a wall-clock time in their own
+// timezone ("10:00 local"). The timezone comes from a CSV column, falling back
+// to DefaultTimezone, then UTC. Jobs are parked in the retry ZSET at the
+// matching UTC instant and promoted by the reconciler like any retry.
+type LocalDelivery struct {
+	Time            string `json:"time"`                       // "HH:MM" local
+	Column          string `json:"column,omitempty"`           // CSV column with an IANA zone; default "timezone"
+	DefaultTimezone string `json:"default_timezone,omitempty"` // for rows without a (valid) zone
+}
+
+func (d *LocalDelivery) Validate() error {
+	if d == nil {
+		return nil
+	}
+	if _, err := parseClock(d.Time); err != nil {
+		return err
+	}
+	if d.DefaultTimezone != "" {
+		if _, err := time.LoadLocation(d.DefaultTimezone); err != nil {
+			return fmt.Errorf("%w: default_timezone %q: %v", ErrInvalidCampaign, d.DefaultTimezone, err)
+		}
+	}
+	return nil
+}
+
+// localScheduler resolves delivery instants during one ingestion, caching
+// loaded timezones.
+type localScheduler struct {
+	at        time.Duration // wall-clock time of day
+	column    string
+	fallback  *time.Location
+	notBefore time.Time
+	zones     map[string]*time.Location
+}
+
+// newLocalScheduler returns nil when the campaign has no local delivery.
+// notBefore is the earliest instant to deliver (now, or the scheduled start).
+func newLocalScheduler(d *LocalDelivery, notBefore time.Time) *localScheduler {
+	if d == nil {
+		return nil
+	}
+	at, err := parseClock(d.Time)
+	if err != nil {
+		return nil
+	}
+	ls := &localScheduler{at: at, column: d.Column, fallback: time.UTC, notBefore: notBefore, zones: map[string]*time.Location{}}
+	if ls.column == "" {
+		ls.column = "timezone"
+	}
+	if d.DefaultTimezone != "" {
+		if loc, err := time.LoadLocation(d.DefaultTimezone); err == nil {
+			ls.fallback = loc
+		}
+	}
+	return ls
+}
+
+func (ls *localScheduler) zone(fields map[string]string) *time.Location {
+	name := fields[ls.column]
+	if name == "" {
+		for k, v := range fields {
+			if strings.EqualFold(k, ls.column) {
+				name = v
+				break
+			}
+		}
+	}
+	if name == "" {
+		return ls.fallback
+	}
+	if loc, ok := ls.zones[name]; ok {
+		return loc
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		loc = ls.fallback
+	}
+	ls.zones[name] = loc
+	return loc
+}
+
+// deliverAt is the first local delivery time at or after notBefore.
+func (ls *localScheduler) deliverAt(fields map[string]string) time.Time {
+	loc := ls.zone(fields)
+	local := ls.notBefore.In(loc)
+	for i := 0; i < 2; i++ {
+		day := local.AddDate(0, 0, i)
+		at := clockOn(day, ls.at, loc)
+		if !at.Before(ls.notBefore) {
+			return at
+		}
+	}
+	return ls.notBefore // unreachable
+}
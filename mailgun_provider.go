@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// Mailgun messages API provider (POST /v3/{domain}/messages, multipart form).
+type MailgunProvider struct {
+	apiKey  string
+	domain  string // sending domain
+	baseURL string // https://api.mailgun.net (https://api.eu.mailgun.net for EU), or a local stub
+	client  *http.Client
+}
+
+func NewMailgunProvider(apiKey, domain, baseURL string) *MailgunProvider {
+	if baseURL == "" {
+		baseURL = "https://api.mailgun.net"
+	}
+	return &MailgunProvider{
+		apiKey:  apiKey,
+		domain:  domain,
+		baseURL: strings.TrimRight(baseURL, "/"),
+		client:  &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (m *MailgunProvider) Name() string { return "mailgun" }
+
+func (m *MailgunProvider) Send(ctx context.Context, msg *Message) error {
+	if err := msg.Validate(); err != nil {
+		return permanentError(m.Name(), err)
+	}
+
+	body, contentType, err := mailgunForm(msg)
+	if err != nil {
+		return permanentError(m.Name(), err)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", m.baseURL+"/v3/"+m.domain+"/messages", body)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth("api", m.apiKey)
+	req.Header.Set("Content-Type", contentType)
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	return httpError(m.Name(), resp)
+}
+
+// mailgunForm maps a Message onto the messages API form: custom headers go
+// in h:<name>, tags in v:<name> (user variables, echoed back in webhooks),
+// and inline images are sent as "inline" files referenced by filename.
+func mailgunForm(msg *Message) (*bytes.Buffer, string, error) {
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	field := func(k, v string) {
+		if v != "" {
+			_ = w.WriteField(k, v)
+		}
+	}
+
+	field("from", msg.From.String())
+	for _, a := range msg.To {
+		field("to", a.String())
+	}
+	for _, a := range msg.Cc {
+		field("cc", a.String())
+	}
+	for _, a := range msg.Bcc {
+		field("bcc", a.String())
+	}
+	field("subject", msg.Subject)
+	field("text", msg.Text)
+	field("html", msg.HTML)
+	if msg.ReplyTo != nil {
+		field("h:Reply-To", msg.ReplyTo.String())
+	}
+	for _, k := range sortedKeys(msg.Headers) {
+		field("h:"+k, msg.Headers[k])
+	}
+	for _, k := range sortedKeys(msg.Tags) {
+		field("v:"+k, msg.Tags[k])
+	}
+
+	for _, a := range msg.Attachments {
+		formName, filename := "attachment", a.Filename
+		if a.ContentID != "" {
+			// Mailgun sets the Content-ID from the filename
+			formName, filename = "inline", strings.Trim(a.ContentID, "<>")
+		}
+		h := textproto.MIMEHeader{}
+		h.Set("Content-Disposition", `form-data; name="`+formName+`"; filename="`+escapeQuotes(filename)+`"`)
+		if a.ContentType != "" {
+			h.Set("Content-Type", a.ContentType)
+		} else {
+			h.Set("Content-Type", "application/octet-stream")
+		}
+		part, err := w.CreatePart(h)
+		if err != nil {
+			return nil, "", err
+		}
+		if _, err := part.Write(a.Content); err != nil {
+			return nil, "", err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return nil, "", err
+	}
+	return &buf, w.FormDataContentType(), nil
+}
+
+func escapeQuotes(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s)
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/mail"
+	"strings"
+)
+
+// Address is a mailbox with an optional display name.
+type Address struct {
+	Name  string `json:"name,omitempty"`
+	Email string `json:"email"`
+}
+
+func (a Address) String() string {
+	return (&mail.Address{Name: a.Name, Address: a.Email}).String()
+}
+
+// Attachment is an inline file carried with a message. Content is raw bytes
+// (base64-encoded on the wire by encoding/json).
+type Attachment struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type,omitempty"`
+	Content     []byte `json:"content"`
+	ContentID   string `json:"content_id,omitempty"` // set for inline images
+}
+
+// Message is everything a provider needs to deliver one email.
+type Message struct {
+	From        Address           `json:"from"`
+	ReplyTo     *Address          `json:"reply_to,omitempty"`
+	To          []Address         `json:"to"`
+	Cc          []Address         `json:"cc,omitempty"`
+	Bcc         []Address         `json:"bcc,omitempty"`
+	Subject     string            `json:"subject"`
+	Text        string            `json:"text,omitempty"`
+	HTML        string            `json:"html,omitempty"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	Attachments []Attachment      `json:"attachments,omitempty"`
+	Tags        map[string]string `json:"tags,omitempty"` // provider metadata (custom args, tags)
+
+	DeliveredBy string `json:"-"` // set by FailoverProvider to the provider that took the message
+}
+
+// Validate checks the minimum a provider needs to accept the message.
+func (m *Message) Validate() error {
+	if m == nil {
+		return errors.New("nil message")
+	}
+	if strings.TrimSpace(m.From.Email) == "" {
+		return errors.New("missing from address")
+	}
+	if len(m.To) == 0 {
+		return errors.New("no recipients")
+	}
+	for _, a := range m.To {
+		if strings.TrimSpace(a.Email) == "" {
+			return errors.New("empty email")
+		}
+	}
+	if m.Subject == "" {
+		return errors.New("missing subject")
+	}
+	if m.Text == "" && m.HTML == "" {
+		return errors.New("missing body")
+	}
+	for k := range m.Headers {
+		if !validHeaderName(k) {
+			return fmt.Errorf("invalid header name %q", k)
+		}
+	}
+	return nil
+}
+
+// validHeaderName reports whether k is an RFC 5322 field-name: printable
+// US-ASCII other than the colon. Anything else (CR, LF, spaces) could smuggle
+// extra headers into the message.
+func validHeaderName(k string) bool {
+	if k == "" {
+		return false
+	}
+	for i := 0; i < len(k); i++ {
+		if k[i] < 33 || k[i] > 126 || k[i] == ':' {
+			return false
+		}
+	}
+	return true
+}
+
+// Merge returns a copy of base with every non-empty field of override applied.
+// Maps are merged key by key, with override winning.
+func (m Message) Merge(override *Message) Message {
+	out := m
+	out.Headers = mergeStringMaps(m.Headers, nil)
+	out.Tags = mergeStringMaps(m.Tags, nil)
+	if override == nil {
+		return out
+	}
+	if override.From.Email != "" {
+		out.From = override.From
+	}
+	if override.ReplyTo != nil {
+		out.ReplyTo = override.ReplyTo
+	}
+	if len(override.To) > 0 {
+		out.To = override.To
+	}
+	if len(override.Cc) > 0 {
+		out.Cc = override.Cc
+	}
+	if len(override.Bcc) > 0 {
+		out.Bcc = override.Bcc
+	}
+	if override.Subject != "" {
+		out.Subject = override.Subject
+	}
+	if override.Text != "" {
+		out.Text = override.Text
+	}
+	if override.HTML != "" {
+		out.HTML = override.HTML
+	}
+	if len(override.Attachments) > 0 {
+		out.Attachments = override.Attachments
+	}
+	out.Headers = mergeStringMaps(out.Headers, override.Headers)
+	out.Tags = mergeStringMaps(out.Tags, override.Tags)
+	return out
+}
+
+func mergeStringMaps(a, b map[string]string) map[string]string {
+	if len(a) == 0 && len(b) == 0 {
+		return nil
+	}
+	out := make(map[string]string, len(a)+len(b))
+	for k, v := range a {
+		out[k] = v
+	}
+	for k, v := range b {
+		out[k] = v
+	}
+	return out
+}
+
+// defaultMessage is used when a campaign has no stored message.
+func defaultMessage() Message {
+	return Message{
+		From:    Address{Email: getenv("DEFAULT_FROM", "no-reply@example.com")},
+		Subject: "Campaign test email",
+		Text:    "Hello from campaign!",
+	}
+}
+
+// campaignMessage returns the stored campaign message layered over the defaults.
+func (c *Controller) campaignMessage(ctx context.Context, campaignID string) (Message, error) {
+	stored, err := c.store.GetMessage(ctx, campaignID)
+	if err != nil {
+		return Message{}, err
+	}
+	return defaultMessage().Merge(stored), nil
+}
+
+// buildMessage assembles the message for one job: campaign message, then the
+// rendered template (if any), then the per-job override, then the recipient.
+func buildMessage(campaignID string, base Message, tpl *compiledTemplate, job JobPayload) (*Message, error) {
+	if tpl != nil {
+		rendered, err := tpl.Render(job)
+		if err != nil {
+			return nil, fmt.Errorf("template for %s: %w", job.Email, err)
+		}
+		base = base.Merge(rendered)
+	}
+	msg := base.Merge(job.Message)
+	if job.Message == nil || len(job.Message.To) == 0 {
+		msg.To = []Address{{Email: job.Email}}
+	}
+	msg.Tags = mergeStringMaps(map[string]string{"campaign_id": campaignID}, msg.Tags)
+	if err := msg.Validate(); err != nil {
+		return nil, fmt.Errorf("build message for %s: %w", job.Email, err)
+	}
+	return &msg, nil
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// mimePart is one node of a MIME tree: its own headers plus encoded body.
+type mimePart struct {
+	header textproto.MIMEHeader
+	body   []byte
+}
+
+// reservedHeaders are written by buildMIME itself; Message.Headers cannot
+// override them (Message-ID can).
+var reservedHeaders = map[string]bool{
+	"From": true, "To": true, "Cc": true, "Bcc": true, "Reply-To": true, "Subject": true, "Date": true,
+	"Mime-Version": true, "Content-Type": true, "Content-Transfer-Encoding": true,
+}
+
+// buildMIME renders msg as an RFC 5322 message with CRLF line endings:
+//
+//	multipart/mixed           when there are regular attachments
+//	  multipart/related       when there are inline (Content-ID) attachments
+//	    multipart/alternative when there is both text and HTML
+//
+// Bcc recipients are left out of the headers; they only go in the envelope.
+func buildMIME(msg *Message, now time.Time) ([]byte, error) {
+	var buf bytes.Buffer
+	hdr := func(k, v string) { fmt.Fprintf(&buf, "%s: %s\r\n", k, v) }
+
+	hdr("From", msg.From.String())
+	hdr("To", joinAddresses(msg.To))
+	if len(msg.Cc) > 0 {
+		hdr("Cc", joinAddresses(msg.Cc))
+	}
+	if msg.ReplyTo != nil {
+		hdr("Reply-To", msg.ReplyTo.String())
+	}
+	hdr("Subject", mime.QEncoding.Encode("utf-8", msg.Subject))
+	hdr("Date", now.Format(time.RFC1123Z))
+	custom := make(map[string]string, len(msg.Headers))
+	for k, v := range msg.Headers {
+		custom[textproto.CanonicalMIMEHeaderKey(k)] = v
+	}
+	if _, ok := custom["Message-Id"]; !ok {
+		hdr("Message-ID", messageID(msg.From.Email))
+	}
+	hdr("MIME-Version", "1.0")
+	for _, k := range sortedKeys(custom) {
+		if !reservedHeaders[k] {
+			hdr(k, mime.QEncoding.Encode("utf-8", custom[k]))
+		}
+	}
+	if len(msg.Tags) > 0 {
+		b, _ := json.Marshal(msg.Tags)
+		hdr("X-Metadata", string(b))
+	}
+
+	root, err := messageBody(msg)
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range []string{"Content-Type", "Content-Transfer-Encoding"} {
+		if v := root.header.Get(k); v != "" {
+			hdr(k, v)
+		}
+	}
+	buf.WriteString("\r\n")
+	buf.Write(root.body)
+	return buf.Bytes(), nil
+}
+
+func messageBody(msg *Message) (mimePart, error) {
+	var body mimePart
+	switch {
+	case msg.Text != "" && msg.HTML != "":
+		var err error
+		if body, err = multipartOf("alternative", textPart("text/plain", msg.Text), textPart("text/html", msg.HTML)); err != nil {
+			return body, err
+		}
+	case msg.HTML != "":
+		body = textPart("text/html", msg.HTML)
+	default:
+		body = textPart("text/plain", msg.Text)
+	}
+
+	var inline, attached []mimePart
+	for _, a := range msg.Attachments {
+		if a.ContentID != "" {
+			inline = append(inline, attachmentPart(a))
+		} else {
+			attached = append(attached, attachmentPart(a))
+		}
+	}
+	var err error
+	if len(inline) > 0 {
+		if body, err = multipartOf("related", append([]mimePart{body}, inline...)...); err != nil {
+			return body, err
+		}
+	}
+	if len(attached) > 0 {
+		if body, err = multipartOf("mixed", append([]mimePart{body}, attached...)...); err != nil {
+			return body, err
+		}
+	}
+	return body, nil
+}
+
+func multipartOf(subtype string, parts ...mimePart) (mimePart, error) {
+	var b bytes.Buffer
+	mw := multipart.NewWriter(&b)
+	for _, p := range parts {
+		w, err := mw.CreatePart(p.header)
+		if err != nil {
+			return mimePart{}, err
+		}
+		if _, err := w.Write(p.body); err != nil {
+			return mimePart{}, err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return mimePart{}, err
+	}
+	h := textproto.MIMEHeader{}
+	h.Set("Content-Type", mime.FormatMediaType("multipart/"+subtype, map[string]string{"boundary": mw.Boundary()}))
+	return mimePart{header: h, body: b.Bytes()}, nil
+}
+
+func textPart(contentType, text string) mimePart {
+	var b bytes.Buffer
+	w := quotedprintable.NewWriter(&b)
+	_, _ = w.Write([]byte(text))
+	_ = w.Close()
+	h := textproto.MIMEHeader{}
+	h.Set("Content-Type", contentType+"; charset=utf-8")
+	h.Set("Content-Transfer-Encoding", "quoted-printable")
+	return mimePart{header: h, body: b.Bytes()}
+}
+
+func attachmentPart(a Attachment) mimePart {
+	ct := a.ContentType
+	if ct == "" {
+		ct = mime.TypeByExtension(filepath.Ext(a.Filename))
+	}
+	if ct == "" {
+		ct = "application/octet-stream"
+	}
+	disposition := "attachment"
+	h := textproto.MIMEHeader{}
+	if a.ContentID != "" {
+		disposition = "inline"
+		h.Set("Content-ID", "<"+strings.Trim(a.ContentID, "<>")+">")
+	}
+	h.Set("Content-Type", mime.FormatMediaType(ct, map[string]string{"name": a.Filename}))
+	h.Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": a.Filename}))
+	h.Set("Content-Transfer-Encoding", "base64")
+
+	enc := base64.StdEncoding.EncodeToString(a.Content)
+	var b bytes.Buffer
+	for len(enc) > 76 {
+		b.WriteString(enc[:76] + "\r\n")
+		enc = enc[76:]
+	}
+	b.WriteString(enc + "\r\n")
+	return mimePart{header: h, body: b.Bytes()}
+}
+
+func joinAddresses(as []Address) string {
+	out := make([]string, 0, len(as))
+	for _, a := range as {
+		out = append(out, a.String())
+	}
+	return strings.Join(out, ", ")
+}
+
+// messageID makes a unique Message-ID in the sender's domain.
+func messageID(from string) string {
+	b := make([]byte, 12)
+	_, _ = rand.Read(b)
+	domain := recipientDomain(from)
+	if domain == "" {
+		domain = "localhost"
+	}
+	return fmt.Sprintf("<%d.%s@%s>", time.Now().UnixNano(), hex.EncodeToString(b), domain)
+}
+
+// envelopeRecipients is every address the message goes to, Bcc included.
+func envelopeRecipients(msg *Message) []string {
+	var out []string
+	for _, list := range [][]Address{msg.To, msg.Cc, msg.Bcc} {
+		for _, a := range list {
+			out = append(out, a.Email)
+		}
+	}
+	return out
+}
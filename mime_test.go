@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBuildMIMEHeaders(t *testing.T) {
+	msg := &Message{
+		From:    Address{Name: "Shop", Email: "news@shop.example"},
+		ReplyTo: &Address{Email: "help@shop.example"},
+		To:      []Address{{Name: "Ann", Email: "ann@x.com"}},
+		Cc:      []Address{{Email: "cc@x.com"}},
+		Bcc:     []Address{{Email: "hidden@x.com"}},
+		Subject: "Grüße",
+		Text:    "hello",
+		Headers: map[string]string{"x-campaign": "c1", "subject": "overridden?", "List-Unsubscribe": "<mailto:u@shop.example>"},
+		Tags:    map[string]string{"campaign_id": "c1"},
+	}
+	raw, err := buildMIME(msg, time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(raw, []byte("hidden@x.com")) {
+		t.Fatal("Bcc leaked into the headers")
+	}
+	m, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	subject, _ := new(mime.WordDecoder).DecodeHeader(m.Header.Get("Subject"))
+	for k, want := range map[string]string{
+		"From":             `"Shop" <news@shop.example>`,
+		"To":               `"Ann" <ann@x.com>`,
+		"Cc":               "<cc@x.com>",
+		"Reply-To":         "<help@shop.example>",
+		"Date":             "Fri, 16 Oct 2026 12:00:00 +0000",
+		"Mime-Version":     "1.0",
+		"X-Campaign":       "c1",
+		"List-Unsubscribe": "<mailto:u@shop.example>",
+		"X-Metadata":       `{"campaign_id":"c1"}`,
+		"Content-Type":     "text/plain; charset=utf-8",
+	} {
+		if got := m.Header.Get(k); got != want {
+			t.Errorf("%s = %q, want %q", k, got, want)
+		}
+	}
+	if subject != "Grüße" || len(m.Header["Subject"]) != 1 {
+		t.Errorf("Subject = %q (%d headers), want the message subject only", subject, len(m.Header["Subject"]))
+	}
+	if !strings.HasSuffix(m.Header.Get("Message-Id"), "@shop.example>") {
+		t.Errorf("Message-ID %q not in the sender's domain", m.Header.Get("Message-Id"))
+	}
+}
+
+func TestBuildMIMEStructure(t *testing.T) {
+	msg := &Message{
+		From:    Address{Email: "a@x.com"},
+		To:      []Address{{Email: "b@x.com"}},
+		Subject: "s",
+		Text:    "plain",
+		HTML:    `<img src="cid:logo">`,
+		Attachments: []Attachment{
+			{Filename: "logo.png", Content: []byte("png"), ContentID: "logo"},
+			{Filename: "invoice.pdf", Content: bytes.Repeat([]byte("p"), 200)},
+		},
+	}
+	raw, err := buildMIME(msg, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(bytes.ReplaceAll(raw, []byte("\r\n"), nil), []byte("\n")) {
+		t.Fatal("bare LF in message")
+	}
+	m, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// mixed[related[alternative[text, html], logo], invoice]
+	mixed := readParts(t, m.Header.Get("Content-Type"), m.Body, "multipart/mixed")
+	if len(mixed) != 2 || mixed[1].header.Get("Content-Disposition") != `attachment; filename=invoice.pdf` {
+		t.Fatalf("mixed parts: %+v", mixed)
+	}
+	related := readParts(t, mixed[0].header.Get("Content-Type"), bytes.NewReader(mixed[0].body), "multipart/related")
+	if len(related) != 2 || related[1].header.Get("Content-Id") != "<logo>" || string(related[1].body) != "cG5n\r\n" {
+		t.Fatalf("related parts: %+v", related)
+	}
+	alt := readParts(t, related[0].header.Get("Content-Type"), bytes.NewReader(related[0].body), "multipart/alternative")
+	if len(alt) != 2 || !strings.HasPrefix(alt[0].header.Get("Content-Type"), "text/plain") || !strings.HasPrefix(alt[1].header.Get("Content-Type"), "text/html") {
+		t.Fatalf("alternative parts: %+v", alt)
+	}
+}
+
+func readParts(t *testing.T, contentType string, r io.Reader, want string) []mimePart {
+	t.Helper()
+	mt, params, err := mime.ParseMediaType(contentType)
+	if err != nil || mt != want {
+		t.Fatalf("content type %q, want %s", contentType, want)
+	}
+	var parts []mimePart
+	mr := multipart.NewReader(r, params["boundary"])
+	for {
+		p, err := mr.NextRawPart()
+		if err == io.EOF {
+			return parts
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(p)
+		parts = append(parts, mimePart{header: p.Header, body: body})
+	}
+}
+
+func TestMessageValidateHeaderNames(t *testing.T) {
+	msg := func(k string) *Message {
+		return &Message{From: Address{Email: "a@x.com"}, To: []Address{{Email: "b@x.com"}}, Subject: "s", Text: "t",
+			Headers: map[string]string{k: "v"}}
+	}
+	for _, k := range []string{"X-Campaign", "List-Unsubscribe-Post", "X_Odd.Name"} {
+		if err := msg(k).Validate(); err != nil {
+			t.Errorf("%q rejected: %v", k, err)
+		}
+	}
+	for _, k := range []string{"", "X-A: b\r\nBcc: victim@x", "X-A\nBcc", "X A", "X-A:", "X-Ü"} {
+		if err := msg(k).Validate(); err == nil {
+			t.Errorf("%q accepted", k)
+		}
+	}
+}
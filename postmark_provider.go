@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Postmark /email provider.
+type PostmarkProvider struct {
+	token   string // server API token
+	stream  string // message stream; "" = the server's default transactional stream
+	baseURL string // https://api.postmarkapp.com, or a local stub
+	client  *http.Client
+}
+
+func NewPostmarkProvider(token, stream, baseURL string) *PostmarkProvider {
+	if baseURL == "" {
+		baseURL = "https://api.postmarkapp.com"
+	}
+	return &PostmarkProvider{
+		token:   token,
+		stream:  stream,
+		baseURL: strings.TrimRight(baseURL, "/"),
+		client:  &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (p *PostmarkProvider) Name() string { return "postmark" }
+
+func (p *PostmarkProvider) Send(ctx context.Context, msg *Message) error {
+	if err := msg.Validate(); err != nil {
+		return permanentError(p.Name(), err)
+	}
+
+	_, err := p.post(ctx, "/email", postmarkPayload(msg, p.stream))
+	return err
+}
+
+// postmarkBatchMax is the most messages /email/batch takes per call.
+const postmarkBatchMax = 500
+
+func (p *PostmarkProvider) MaxBatch() int { return postmarkBatchMax }
+
+// SendBatch sends up to 500 messages per /email/batch call. Postmark accepts
+// or rejects each message on its own and says which in the response array.
+func (p *PostmarkProvider) SendBatch(ctx context.Context, msgs []*Message) []error {
+	errs := make([]error, len(msgs))
+	var idx []int
+	var payloads []map[string]any
+	for i, msg := range msgs {
+		if err := msg.Validate(); err != nil {
+			errs[i] = permanentError(p.Name(), err)
+			continue
+		}
+		idx = append(idx, i)
+		payloads = append(payloads, postmarkPayload(msg, p.stream))
+	}
+	for len(idx) > 0 {
+		n := len(idx)
+		if n > postmarkBatchMax {
+			n = postmarkBatchMax
+		}
+		body, err := p.post(ctx, "/email/batch", payloads[:n])
+		var results []struct {
+			ErrorCode int
+			Message   string
+		}
+		if err == nil && json.Unmarshal(body, &results) != nil {
+			err = &ProviderError{Provider: p.Name(), Class: ErrClassTransient, Message: "unreadable batch response"}
+		}
+		for k, i := range idx[:n] {
+			switch {
+			case err != nil:
+				errs[i] = err
+			case k >= len(results):
+				errs[i] = &ProviderError{Provider: p.Name(), Class: ErrClassTransient, Message: "no result for message"}
+			case results[k].ErrorCode != 0:
+				errs[i] = &ProviderError{Provider: p.Name(), Class: postmarkClass(results[k].ErrorCode),
+					StatusCode: http.StatusUnprocessableEntity, Message: results[k].Message}
+			}
+		}
+		idx, payloads = idx[n:], payloads[n:]
+	}
+	return errs
+}
+
+// post sends one API request and returns the response body on success.
+func (p *PostmarkProvider) post(ctx context.Context, path string, payload any) ([]byte, error) {
+	b, _ := json.Marshal(payload)
+	req, err := http.NewRequestWithContext(ctx, "POST", p.baseURL+path, bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Postmark-Server-Token", p.token)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return io.ReadAll(resp.Body)
+	}
+	return nil, postmarkError(p.Name(), resp)
+}
+
+// postmarkPayload maps a Message onto the /email body.
+func postmarkPayload(msg *Message, stream string) map[string]any {
+	payload := map[string]any{
+		"From":    msg.From.String(),
+		"To":      joinAddresses(msg.To),
+		"Subject": msg.Subject,
+	}
+	if len(msg.Cc) > 0 {
+		payload["Cc"] = joinAddresses(msg.Cc)
+	}
+	if len(msg.Bcc) > 0 {
+		payload["Bcc"] = joinAddresses(msg.Bcc)
+	}
+	if msg.ReplyTo != nil {
+		payload["ReplyTo"] = msg.ReplyTo.String()
+	}
+	if msg.Text != "" {
+		payload["TextBody"] = msg.Text
+	}
+	if msg.HTML != "" {
+		payload["HtmlBody"] = msg.HTML
+	}
+	if len(msg.Tags) > 0 {
+		payload["Metadata"] = msg.Tags
+	}
+	if stream != "" {
+		payload["MessageStream"] = stream
+	}
+	if len(msg.Headers) > 0 {
+		hs := make([]map[string]string, 0, len(msg.Headers))
+		for _, k := range sortedKeys(msg.Headers) {
+			hs = append(hs, map[string]string{"Name": k, "Value": msg.Headers[k]})
+		}
+		payload["Headers"] = hs
+	}
+	if len(msg.Attachments) > 0 {
+		atts := make([]map[string]string, 0, len(msg.Attachments))
+		for _, a := range msg.Attachments {
+			att := map[string]string{
+				"Name":        a.Filename,
+				"Content":     base64.StdEncoding.EncodeToString(a.Content),
+				"ContentType": a.ContentType,
+			}
+			if att["ContentType"] == "" {
+				att["ContentType"] = "application/octet-stream"
+			}
+			if a.ContentID != "" {
+				att["ContentID"] = "cid:" + strings.Trim(a.ContentID, "<>")
+			}
+			atts = append(atts, att)
+		}
+		payload["Attachments"] = atts
+	}
+	return payload
+}
+
+// postmarkError classifies a failed Postmark call. Postmark answers most
+// rejections with 422 and an ErrorCode in the body; the account-level ones
+// are treated like bad credentials so the campaign pauses rather than burning
+// through the list.
+func postmarkError(provider string, resp *http.Response) *ProviderError {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4<<10))
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	e := httpError(provider, resp)
+	if resp.StatusCode != http.StatusUnprocessableEntity {
+		return e
+	}
+	var parsed struct{ ErrorCode int }
+	_ = json.Unmarshal(body, &parsed)
+	e.Class = postmarkClass(parsed.ErrorCode)
+	return e
+}
+
+// postmarkClass classifies a Postmark ErrorCode on a rejected message.
+func postmarkClass(code int) string {
+	switch code {
+	case 10, 405, 412: // bad token, sending not allowed, account pending approval
+		return ErrClassAuth
+	default:
+		return ErrClassPermanent
+	}
+}
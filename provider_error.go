@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ProviderError is what providers return when a send fails for a reason they
+// understand. Class (one of the ErrClass* values) drives what the worker does
+// next; RetryAfter is set when the provider said how long to back off.
+type ProviderError struct {
+	Provider   string
+	Class      string
+	StatusCode int           // HTTP / SMTP status, 0 if none
+	RetryAfter time.Duration // for ErrClassThrottled; 0 = not given
+	Message    string
+}
+
+func (e *ProviderError) Error() string {
+	s := fmt.Sprintf("%s %s", e.Provider, e.Class)
+	if e.StatusCode != 0 {
+		s += fmt.Sprintf(" status=%d", e.StatusCode)
+	}
+	if e.Message != "" {
+		s += ": " + e.Message
+	}
+	return s
+}
+
+// permanentError wraps an error that no retry can fix (e.g. an invalid message).
+func permanentError(provider string, err error) *ProviderError {
+	return &ProviderError{Provider: provider, Class: ErrClassPermanent, Message: err.Error()}
+}
+
+// httpError classifies a non-2xx response from an HTTP mail API. It reads (a
+// bounded part of) the body for the provider's explanation.
+func httpError(provider string, resp *http.Response) *ProviderError {
+	e := &ProviderError{Provider: provider, StatusCode: resp.StatusCode}
+	switch code := resp.StatusCode; {
+	case code == http.StatusUnauthorized || code == http.StatusForbidden:
+		e.Class = ErrClassAuth
+	case code == http.StatusTooManyRequests:
+		e.Class = ErrClassThrottled
+		e.RetryAfter = parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+	case code == http.StatusRequestTimeout || code >= 500:
+		e.Class = ErrClassTransient
+	default:
+		e.Class = ErrClassPermanent
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4<<10))
+	e.Message = errorMessage(body)
+	return e
+}
+
+// parseRetryAfter accepts delay-seconds or an HTTP date; 0 if absent or bad.
+func parseRetryAfter(v string, now time.Time) time.Duration {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
+}
+
+// errorMessage pulls a readable message out of a provider error body:
+// {"errors":[{"message":..}]} (SendGrid), {"message":..} (Mailgun, Postmark),
+// or the raw text.
+func errorMessage(body []byte) string {
+	var parsed struct {
+		Message string `json:"message"`
+		Errors  []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	if json.Unmarshal(body, &parsed) == nil {
+		var msgs []string
+		for _, e := range parsed.Errors {
+			if e.Message != "" {
+				msgs = append(msgs, e.Message)
+			}
+		}
+		if len(msgs) > 0 {
+			return strings.Join(msgs, "; ")
+		}
+		if parsed.Message != "" {
+			return parsed.Message
+		}
+	}
+	return strings.TrimSpace(string(body))
+}
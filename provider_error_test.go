@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHTTPError(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     int
+		retryAfter string
+		body       string
+		class      string
+		wait       time.Duration
+		message    string
+	}{
+		{"unauthorized", 401, "", `{"errors":[{"message":"bad key"}]}`, ErrClassAuth, 0, "bad key"},
+		{"forbidden", 403, "", `{"message":"domain not verified"}`, ErrClassAuth, 0, "domain not verified"},
+		{"rate limited", 429, "7", "", ErrClassThrottled, 7 * time.Second, ""},
+		{"rate limited without retry-after", 429, "", "", ErrClassThrottled, 0, ""},
+		{"request timeout", 408, "", "", ErrClassTransient, 0, ""},
+		{"server error", 503, "", "upstream down\n", ErrClassTransient, 0, "upstream down"},
+		{"bad request", 400, "", `{"errors":[{"message":"a"},{"message":"b"}]}`, ErrClassPermanent, 0, "a; b"},
+		{"unprocessable", 422, "", `not json`, ErrClassPermanent, 0, "not json"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &http.Response{StatusCode: tt.status, Header: http.Header{}, Body: io.NopCloser(strings.NewReader(tt.body))}
+			if tt.retryAfter != "" {
+				resp.Header.Set("Retry-After", tt.retryAfter)
+			}
+			e := httpError("test", resp)
+			if e.Class != tt.class || e.RetryAfter != tt.wait || e.Message != tt.message || e.StatusCode != tt.status {
+				t.Fatalf("got %+v, want class=%s wait=%s message=%q", e, tt.class, tt.wait, tt.message)
+			}
+		})
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		in   string
+		want time.Duration
+	}{
+		{"", 0},
+		{"30", 30 * time.Second},
+		{" 5 ", 5 * time.Second},
+		{"-1", 0},
+		{now.Add(90 * time.Second).Format(http.TimeFormat), 90 * time.Second},
+		{now.Add(-time.Minute).Format(http.TimeFormat), 0},
+		{"tomorrow", 0},
+	}
+	for _, tt := range tests {
+		if got := parseRetryAfter(tt.in, now); got != tt.want {
+			t.Errorf("parseRetryAfter(%q) = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestErrorClass(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"provider error", &ProviderError{Provider: "x", Class: ErrClassAuth}, ErrClassAuth},
+		{"wrapped provider error", fmt.Errorf("send: %w", &ProviderError{Provider: "x", Class: ErrClassPermanent}), ErrClassPermanent},
+		{"deadline", context.DeadlineExceeded, ErrClassTimeout},
+		{"wrapped deadline", fmt.Errorf("post: %w", context.DeadlineExceeded), ErrClassTimeout},
+		{"net timeout", &net.OpError{Op: "read", Err: timeoutError{}}, ErrClassTimeout},
+		{"connection refused", &net.OpError{Op: "dial", Err: errors.New("connection refused")}, ErrClassNetwork},
+		{"anything else", errors.New("boom"), ErrClassTransient},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := errorClass(tt.err); got != tt.want {
+				t.Fatalf("errorClass(%v) = %q, want %q", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleSendErrorThrottleCap(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryQueueStore()
+	c := NewController(store, NewProviderRegistry(), 1)
+	camp, err := c.CreateCampaign(ctx, &Campaign{CampaignDef: CampaignDef{Name: "throttled",
+		RetryPolicy: &RetryPolicy{MaxAttempts: 2, MaxThrottleWait: "1h"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	throttled := &ProviderError{Provider: "ses", Class: ErrClassThrottled, StatusCode: 429, RetryAfter: time.Minute}
+	retried := func() JobPayload {
+		t.Helper()
+		items, _, err := store.Retries(ctx, camp.ID, 0, 10)
+		if err != nil || len(items) != 1 {
+			t.Fatalf("retries %v err=%v, want one", items, err)
+		}
+		var job JobPayload
+		_ = json.Unmarshal([]byte(items[0].Payload), &job)
+		_, _ = store.DrainPending(ctx, camp.ID, 10)
+		return job
+	}
+
+	c.handleSendError(ctx, camp.ID, "w1", JobPayload{ID: "1", Email: "a@x.com"}, throttled)
+	job := retried()
+	if job.Attempts != 0 || job.ThrottledSince == nil {
+		t.Fatalf("first throttle: %+v, want a free deferral that starts the clock", job)
+	}
+
+	since := time.Now().Add(-2 * time.Hour)
+	job.ThrottledSince = &since
+	c.handleSendError(ctx, camp.ID, "w1", job, throttled)
+	if job = retried(); job.Attempts != 1 {
+		t.Fatalf("past max_throttle_wait: attempts %d, want 1", job.Attempts)
+	}
+	c.handleSendError(ctx, camp.ID, "w1", job, throttled)
+	if _, n, _ := store.DeadLetters(ctx, camp.ID, 0, 10); n != 1 {
+		t.Fatalf("%d dead letters, want the job once its attempts ran out", n)
+	}
+}
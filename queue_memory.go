@@ -0,0 +1,841 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var _ QueueStore = (*MemoryQueueStore)(nil)
+
+// MemoryQueueStore keeps every structure of RedisQueueStore in process, behind
+// one mutex, so each method is as atomic as its Lua counterpart. Nothing
+// survives a restart and only one process can use it: it is meant for tests
+// and single-binary deployments.
+type MemoryQueueStore struct {
+	mu        sync.Mutex
+	campaigns map[string]*memCampaign
+	limits    map[string]RateLimit // scope -> limit (global, provider:, domain:)
+	tats      map[string]int64     // scope -> GCRA theoretical arrival time (unix ms)
+	schedules map[string]map[string]int64
+	// wake is closed (and replaced) whenever a queue grows, waking blocked pops.
+	wake chan struct{}
+}
+
+// memCampaign mirrors the per-campaign Redis keys.
+type memCampaign struct {
+	registered bool
+	queue      []string            // FIFO: push at the end, pop from the front
+	held       map[string][]string // token -> jobs drained by HoldPending, awaiting ReleaseHeld
+	processing map[string]int      // raw -> copies in flight
+	leases     map[string]int64    // raw -> deadline (unix ms)
+	owners     map[string]string
+	retry      map[string]int64 // raw -> due (unix seconds)
+	dead       map[string]memDead
+	deadSeq    int64
+	delivered  map[string]Delivery // email -> latest delivery
+	progress   map[string]string
+	status     *string
+	rateLimit  *int64
+	rateBurst  *int64
+	rateCount  int64
+	countUntil int64 // end of the rateCount window (unix ms)
+	message    []byte
+	template   string
+	columns    []string
+	def        []byte
+}
+
+func NewMemoryQueueStore() *MemoryQueueStore {
+	return &MemoryQueueStore{
+		campaigns: map[string]*memCampaign{},
+		limits:    map[string]RateLimit{},
+		tats:      map[string]int64{},
+		schedules: map[string]map[string]int64{scheduleStart: {}, scheduleStop: {}},
+		wake:      make(chan struct{}),
+	}
+}
+
+// memDead is one dead letter; seq breaks ties between equal failure times.
+type memDead struct {
+	payload string
+	at      int64
+	seq     int64
+}
+
+// campaign returns the campaign's state, creating it on first use (Redis keys
+// spring into existence the same way). Callers hold s.mu.
+func (s *MemoryQueueStore) campaign(campaignID string) *memCampaign {
+	mc, ok := s.campaigns[campaignID]
+	if !ok {
+		mc = &memCampaign{
+			processing: map[string]int{},
+			leases:     map[string]int64{},
+			owners:     map[string]string{},
+			retry:      map[string]int64{},
+			dead:       map[string]memDead{},
+			held:       map[string][]string{},
+			delivered:  map[string]Delivery{},
+			progress:   map[string]string{},
+		}
+		s.campaigns[campaignID] = mc
+	}
+	return mc
+}
+
+// push appends to the queue and wakes blocked pops. Callers hold s.mu.
+func (s *MemoryQueueStore) push(mc *memCampaign, items ...string) {
+	if len(items) == 0 {
+		return
+	}
+	mc.queue = append(mc.queue, items...)
+	close(s.wake)
+	s.wake = make(chan struct{})
+}
+
+// unprocess drops one in-flight copy of raw. Callers hold s.mu.
+func (mc *memCampaign) unprocess(raw string) bool {
+	n := mc.processing[raw]
+	if n == 0 {
+		return false
+	}
+	if n == 1 {
+		delete(mc.processing, raw)
+	} else {
+		mc.processing[raw] = n - 1
+	}
+	return true
+}
+
+func (mc *memCampaign) release(raw string) {
+	delete(mc.leases, raw)
+	delete(mc.owners, raw)
+}
+
+// retriesDue returns up to max retry members due at or before now, in score
+// order (ties broken by member, like a ZSET). Callers hold s.mu.
+func (mc *memCampaign) retriesDue(now int64, max int) []string {
+	due := make([]string, 0)
+	for raw, at := range mc.retry {
+		if at <= now {
+			due = append(due, raw)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool {
+		if a, b := mc.retry[due[i]], mc.retry[due[j]]; a != b {
+			return a < b
+		}
+		return due[i] < due[j]
+	})
+	if len(due) > max {
+		due = due[:max]
+	}
+	return due
+}
+
+func (s *MemoryQueueStore) Enqueue(ctx context.Context, campaignID string, payload any) error {
+	return s.EnqueueBatch(ctx, campaignID, []any{payload})
+}
+
+func (s *MemoryQueueStore) EnqueueBatch(ctx context.Context, campaignID string, payloads []any) error {
+	items := make([]string, 0, len(payloads))
+	for _, p := range payloads {
+		b, err := json.Marshal(p)
+		if err != nil {
+			return err
+		}
+		items = append(items, string(b))
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.push(s.campaign(campaignID), items...)
+	return nil
+}
+
+// PopToProcessing blocks up to timeout for a job, moving it to processing
+// under a lease exactly like the Redis backend.
+func (s *MemoryQueueStore) PopToProcessing(ctx context.Context, campaignID, workerID string, lease, timeout time.Duration) (string, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		s.mu.Lock()
+		mc := s.campaign(campaignID)
+		if len(mc.queue) > 0 {
+			raw := mc.queue[0]
+			mc.queue[0] = ""
+			mc.queue = mc.queue[1:]
+			now := time.Now()
+			mc.processing[raw]++
+			mc.leases[raw] = now.Add(lease).UnixMilli()
+			mc.owners[raw] = fmt.Sprintf("%s|%d", workerID, now.UnixMilli())
+			s.mu.Unlock()
+			return raw, nil
+		}
+		wake := s.wake
+		s.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-timer.C:
+			return "", nil
+		case <-wake:
+		}
+	}
+}
+
+func (s *MemoryQueueStore) RemoveFromProcessing(ctx context.Context, campaignID, payload string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	mc := s.campaign(campaignID)
+	mc.unprocess(payload)
+	mc.release(payload)
+	return nil
+}
+
+func (s *MemoryQueueStore) ExtendLease(ctx context.Context, campaignID, payload, workerID string, lease time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	mc := s.campaign(campaignID)
+	if !strings.HasPrefix(mc.owners[payload], workerID+"|") {
+		return false, nil
+	}
+	if _, ok := mc.leases[payload]; !ok {
+		return false, nil
+	}
+	mc.leases[payload] = time.Now().Add(lease).UnixMilli()
+	return true, nil
+}
+
+// RequeueExpired has nothing to adopt (pop and lease happen together here),
+// so it only moves jobs whose lease ran out back to the queue.
+func (s *MemoryQueueStore) RequeueExpired(ctx context.Context, campaignID string, lease time.Duration, max int) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	mc := s.campaign(campaignID)
+	now := time.Now().UnixMilli()
+	var expired []string
+	for raw, deadline := range mc.leases {
+		if deadline <= now {
+			expired = append(expired, raw)
+		}
+	}
+	sort.Slice(expired, func(i, j int) bool { return mc.leases[expired[i]] < mc.leases[expired[j]] })
+	if len(expired) > max {
+		expired = expired[:max]
+	}
+	var back []string
+	for _, raw := range expired {
+		mc.release(raw)
+		if mc.unprocess(raw) {
+			back = append(back, raw)
+		}
+	}
+	s.push(mc, back...)
+	return len(back), nil
+}
+
+// DrainPending takes from the queue first, then processing, then retries.
+func (s *MemoryQueueStore) DrainPending(ctx context.Context, campaignID string, max int) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.drain(s.campaign(campaignID), max), nil
+}
+
+func (s *MemoryQueueStore) HoldPending(ctx context.Context, campaignID, token string, max int) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	mc := s.campaign(campaignID)
+	out := s.drain(mc, max)
+	if len(out) > 0 {
+		mc.held[token] = append(mc.held[token], out...)
+	}
+	return out, nil
+}
+
+func (s *MemoryQueueStore) ReleaseHeld(ctx context.Context, campaignID, token string, requeue bool) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	mc := s.campaign(campaignID)
+	held := mc.held[token]
+	if requeue {
+		s.push(mc, held...)
+	}
+	delete(mc.held, token)
+	return len(held), nil
+}
+
+func (s *MemoryQueueStore) HeldTokens(ctx context.Context, campaignID string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tokens := make([]string, 0)
+	for token := range s.campaign(campaignID).held {
+		tokens = append(tokens, token)
+	}
+	sort.Strings(tokens)
+	return tokens, nil
+}
+
+// drain removes up to max pending jobs: queue first, then processing, then
+// retries. Callers hold s.mu.
+func (s *MemoryQueueStore) drain(mc *memCampaign, max int) []string {
+	out := make([]string, 0)
+
+	n := len(mc.queue)
+	if n > max {
+		n = max
+	}
+	out = append(out, mc.queue[:n]...)
+	mc.queue = mc.queue[n:]
+
+	for raw, copies := range mc.processing {
+		for ; copies > 0 && len(out) < max; copies-- {
+			out = append(out, raw)
+			mc.unprocess(raw)
+		}
+		if copies == 0 {
+			mc.release(raw)
+		}
+		if len(out) >= max {
+			break
+		}
+	}
+
+	if want := max - len(out); want > 0 {
+		for _, raw := range mc.retriesDue(math.MaxInt64, want) {
+			delete(mc.retry, raw)
+			out = append(out, raw)
+		}
+	}
+	return out
+}
+
+func (s *MemoryQueueStore) AddRetry(ctx context.Context, campaignID string, unixTs int64, payload string) error {
+	return s.AddRetryBatch(ctx, campaignID, []retryItem{{At: unixTs, Payload: payload}})
+}
+
+func (s *MemoryQueueStore) AddRetryBatch(ctx context.Context, campaignID string, items []retryItem) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	mc := s.campaign(campaignID)
+	for _, it := range items {
+		mc.retry[it.Payload] = it.At
+	}
+	return nil
+}
+
+func (s *MemoryQueueStore) PromoteDueRetries(ctx context.Context, campaignID string, now int64, max int) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	mc := s.campaign(campaignID)
+	due := mc.retriesDue(now, max)
+	for _, raw := range due {
+		delete(mc.retry, raw)
+	}
+	s.push(mc, due...)
+	return len(due), nil
+}
+
+func (s *MemoryQueueStore) Retries(ctx context.Context, campaignID string, offset, limit int) ([]retryItem, int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	mc := s.campaign(campaignID)
+	all := mc.retriesDue(math.MaxInt64, len(mc.retry))
+	out := make([]retryItem, 0)
+	for i := offset; i >= 0 && i < len(all) && len(out) < limit; i++ {
+		out = append(out, retryItem{At: mc.retry[all[i]], Payload: all[i]})
+	}
+	return out, int64(len(all)), nil
+}
+
+func (s *MemoryQueueStore) AddDeadLetter(ctx context.Context, campaignID, jobID, payload string, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	mc := s.campaign(campaignID)
+	mc.deadSeq++
+	mc.dead[jobID] = memDead{payload: payload, at: at.UnixMilli(), seq: mc.deadSeq}
+	return nil
+}
+
+// deadOrder returns dead letter IDs oldest first. Callers hold s.mu.
+func (mc *memCampaign) deadOrder() []string {
+	ids := make([]string, 0, len(mc.dead))
+	for id := range mc.dead {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		a, b := mc.dead[ids[i]], mc.dead[ids[j]]
+		if a.at != b.at {
+			return a.at < b.at
+		}
+		return a.seq < b.seq
+	})
+	return ids
+}
+
+func (s *MemoryQueueStore) DeadLetters(ctx context.Context, campaignID string, offset, limit int) ([]string, int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	mc := s.campaign(campaignID)
+	ids := mc.deadOrder()
+	out := make([]string, 0)
+	for i := offset; i >= 0 && i < len(ids) && len(out) < limit; i++ {
+		out = append(out, mc.dead[ids[i]].payload)
+	}
+	return out, int64(len(ids)), nil
+}
+
+func (s *MemoryQueueStore) TakeDeadLetters(ctx context.Context, campaignID string, jobIDs []string, max int) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	mc := s.campaign(campaignID)
+	if len(jobIDs) == 0 {
+		jobIDs = mc.deadOrder()
+		if len(jobIDs) > max {
+			jobIDs = jobIDs[:max]
+		}
+	}
+	out := make([]string, 0, len(jobIDs))
+	for _, id := range jobIDs {
+		if d, ok := mc.dead[id]; ok {
+			delete(mc.dead, id)
+			out = append(out, d.payload)
+		}
+	}
+	return out, nil
+}
+
+func (s *MemoryQueueStore) RecordDeliveries(ctx context.Context, campaignID string, ds []Delivery) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	mc := s.campaign(campaignID)
+	for _, d := range ds {
+		mc.delivered[d.Email] = d
+	}
+	return nil
+}
+
+func (s *MemoryQueueStore) GetDelivery(ctx context.Context, campaignID, email string) (Delivery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d, ok := s.campaign(campaignID).delivered[email]
+	if !ok {
+		return Delivery{}, ErrNotFound
+	}
+	return d, nil
+}
+
+func (s *MemoryQueueStore) InitProgress(ctx context.Context, campaignID string, total int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p := s.campaign(campaignID).progress
+	p["total"] = strconv.FormatInt(total, 10)
+	for _, f := range []string{"sent", "failed"} {
+		if _, ok := p[f]; !ok {
+			p[f] = "0"
+		}
+	}
+	return nil
+}
+
+func (s *MemoryQueueStore) IncrProgress(ctx context.Context, campaignID, field string, delta int64) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p := s.campaign(campaignID).progress
+	n, err := strconv.ParseInt(p[field], 10, 64)
+	if err != nil && p[field] != "" {
+		return 0, fmt.Errorf("progress %s is not an integer", field)
+	}
+	n += delta
+	p[field] = strconv.FormatInt(n, 10)
+	return n, nil
+}
+
+func (s *MemoryQueueStore) DeleteProgress(ctx context.Context, campaignID, field string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if mc, ok := s.campaigns[campaignID]; ok {
+		delete(mc.progress, field)
+	}
+	return nil
+}
+
+func (s *MemoryQueueStore) GetProgress(ctx context.Context, campaignID string) (map[string]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make(map[string]string)
+	if mc, ok := s.campaigns[campaignID]; ok {
+		for k, v := range mc.progress {
+			out[k] = v
+		}
+	}
+	return out, nil
+}
+
+func (s *MemoryQueueStore) CompleteIfDone(ctx context.Context, campaignID string, finishedAt time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	mc := s.campaign(campaignID)
+	if mc.status == nil || *mc.status != StateRunning {
+		return false, nil
+	}
+	if len(mc.queue) > 0 || len(mc.processing) > 0 || len(mc.retry) > 0 {
+		return false, nil
+	}
+	total, err := strconv.ParseInt(mc.progress["total"], 10, 64)
+	if err != nil {
+		return false, nil
+	}
+	var done int64
+	for _, f := range []string{"sent", "failed", "cancelled"} {
+		n, _ := strconv.ParseInt(mc.progress[f], 10, 64)
+		done += n
+	}
+	if done < total {
+		return false, nil
+	}
+	completed := StateCompleted
+	mc.status = &completed
+	mc.progress["finished_at"] = finishedAt.Format(time.RFC3339)
+	return true, nil
+}
+
+func (s *MemoryQueueStore) SetStatus(ctx context.Context, campaignID, status string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.campaign(campaignID).status = &status
+	return nil
+}
+
+func (s *MemoryQueueStore) GetStatus(ctx context.Context, campaignID string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if mc, ok := s.campaigns[campaignID]; ok && mc.status != nil {
+		return *mc.status, nil
+	}
+	return "", ErrNotFound
+}
+
+func (s *MemoryQueueStore) TransitionStatus(ctx context.Context, campaignID string, from []string, to string) (bool, string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	mc := s.campaign(campaignID)
+	var cur string
+	if mc.status != nil {
+		cur = *mc.status
+	}
+	for _, f := range from {
+		if f == cur {
+			mc.status = &to
+			return true, cur, nil
+		}
+	}
+	return false, cur, nil
+}
+
+func (s *MemoryQueueStore) SetRateLimit(ctx context.Context, campaignID string, limit int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.campaign(campaignID).rateLimit = &limit
+	return nil
+}
+
+func (s *MemoryQueueStore) GetRateLimit(ctx context.Context, campaignID string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if mc, ok := s.campaigns[campaignID]; ok && mc.rateLimit != nil {
+		return *mc.rateLimit, nil
+	}
+	return 0, ErrNotFound
+}
+
+func (s *MemoryQueueStore) SetRateBurst(ctx context.Context, campaignID string, burst int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.campaign(campaignID).rateBurst = &burst
+	return nil
+}
+
+func (s *MemoryQueueStore) GetRateBurst(ctx context.Context, campaignID string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if mc, ok := s.campaigns[campaignID]; ok && mc.rateBurst != nil {
+		return *mc.rateBurst, nil
+	}
+	return 0, ErrNotFound
+}
+
+func (s *MemoryQueueStore) SetScopedLimit(ctx context.Context, scope string, limit RateLimit) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.limits[scope] = limit
+	return nil
+}
+
+func (s *MemoryQueueStore) DeleteScopedLimit(ctx context.Context, scope string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.limits, scope)
+	delete(s.tats, scope)
+	return nil
+}
+
+func (s *MemoryQueueStore) GetScopedLimits(ctx context.Context) (map[string]RateLimit, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make(map[string]RateLimit, len(s.limits))
+	for scope, l := range s.limits {
+		out[scope] = l
+	}
+	return out, nil
+}
+
+// TakeRate is the same all-or-nothing GCRA as gcraScript, on the local clock.
+func (s *MemoryQueueStore) TakeRate(ctx context.Context, buckets []rateBucket) (bool, time.Duration, int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now().UnixMilli()
+	tats := make([]int64, len(buckets))
+	var wait int64
+	worst := 0
+	for i, b := range buckets {
+		interval := b.Limit.interval().Milliseconds()
+		if interval < 1 {
+			interval = 1
+		}
+		tat := s.tats[b.Scope]
+		if tat < now {
+			tat = now
+		}
+		newTAT := tat + interval
+		if allowAt := newTAT - interval*b.Limit.Burst; allowAt-now > wait {
+			wait, worst = allowAt-now, i
+		}
+		tats[i] = newTAT
+	}
+	if wait > 0 {
+		return false, time.Duration(wait) * time.Millisecond, worst, nil
+	}
+	for i, b := range buckets {
+		s.tats[b.Scope] = tats[i]
+	}
+	return true, 0, 0, nil
+}
+
+func (s *MemoryQueueStore) RateAvailable(ctx context.Context, scope string, limit RateLimit) (int64, error) {
+	s.mu.Lock()
+	tat, ok := s.tats[scope]
+	s.mu.Unlock()
+	interval := limit.interval().Milliseconds()
+	backlog := tat - time.Now().UnixMilli()
+	if !ok || interval < 1 || backlog <= 0 {
+		return limit.Burst, nil
+	}
+	avail := limit.Burst - (backlog+interval-1)/interval
+	if avail < 0 {
+		avail = 0
+	}
+	return avail, nil
+}
+
+func (s *MemoryQueueStore) IncrRateCount(ctx context.Context, campaignID string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	mc, now := s.campaign(campaignID), time.Now().UnixMilli()
+	if now >= mc.countUntil {
+		mc.rateCount, mc.countUntil = 0, now+time.Minute.Milliseconds()
+	}
+	mc.rateCount++
+	return mc.rateCount, nil
+}
+
+func (s *MemoryQueueStore) GetRateCount(ctx context.Context, campaignID string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	mc := s.campaign(campaignID)
+	if time.Now().UnixMilli() >= mc.countUntil {
+		return 0, nil
+	}
+	return mc.rateCount, nil
+}
+
+// Message and definition are kept as JSON so callers never share pointers
+// with the store.
+func (s *MemoryQueueStore) SetMessage(ctx context.Context, campaignID string, msg *Message) error {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.campaign(campaignID).message = b
+	return nil
+}
+
+func (s *MemoryQueueStore) GetMessage(ctx context.Context, campaignID string) (*Message, error) {
+	s.mu.Lock()
+	var b []byte
+	if mc, ok := s.campaigns[campaignID]; ok {
+		b = mc.message
+	}
+	s.mu.Unlock()
+	if b == nil {
+		return nil, nil
+	}
+	var msg Message
+	if err := json.Unmarshal(b, &msg); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+func (s *MemoryQueueStore) SetTemplate(ctx context.Context, campaignID string, t *Template) error {
+	b, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.campaign(campaignID).template = string(b)
+	return nil
+}
+
+func (s *MemoryQueueStore) GetTemplate(ctx context.Context, campaignID string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if mc, ok := s.campaigns[campaignID]; ok {
+		return mc.template, nil
+	}
+	return "", nil
+}
+
+func (s *MemoryQueueStore) SetColumns(ctx context.Context, campaignID string, columns []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.campaign(campaignID).columns = append([]string(nil), columns...)
+	return nil
+}
+
+func (s *MemoryQueueStore) GetColumns(ctx context.Context, campaignID string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if mc, ok := s.campaigns[campaignID]; ok && mc.columns != nil {
+		return append([]string(nil), mc.columns...), nil
+	}
+	return nil, nil
+}
+
+func (s *MemoryQueueStore) CreateCampaignDef(ctx context.Context, def *CampaignDef) (bool, error) {
+	b, err := json.Marshal(def)
+	if err != nil {
+		return false, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	mc := s.campaign(def.ID)
+	if mc.def != nil {
+		return false, nil
+	}
+	mc.def = b
+	return true, nil
+}
+
+func (s *MemoryQueueStore) SaveCampaignDef(ctx context.Context, def *CampaignDef) error {
+	b, err := json.Marshal(def)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.campaign(def.ID).def = b
+	return nil
+}
+
+func (s *MemoryQueueStore) GetCampaignDef(ctx context.Context, campaignID string) (*CampaignDef, error) {
+	s.mu.Lock()
+	var b []byte
+	if mc, ok := s.campaigns[campaignID]; ok {
+		b = mc.def
+	}
+	s.mu.Unlock()
+	if b == nil {
+		return nil, nil
+	}
+	var def CampaignDef
+	if err := json.Unmarshal(b, &def); err != nil {
+		return nil, err
+	}
+	return &def, nil
+}
+
+func (s *MemoryQueueStore) DeleteCampaign(ctx context.Context, campaignID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.campaigns, campaignID)
+	delete(s.tats, campaignScope(campaignID))
+	for _, sched := range s.schedules {
+		delete(sched, campaignID)
+	}
+	return nil
+}
+
+func (s *MemoryQueueStore) RegisterCampaign(ctx context.Context, campaignID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.campaign(campaignID).registered = true
+}
+
+func (s *MemoryQueueStore) ListCampaigns(ctx context.Context) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]string, 0, len(s.campaigns))
+	for id, mc := range s.campaigns {
+		if mc.registered {
+			out = append(out, id)
+		}
+	}
+	return out, nil
+}
+
+func (s *MemoryQueueStore) SetSchedule(ctx context.Context, campaignID string, start, stop *time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for kind, at := range map[string]*time.Time{scheduleStart: start, scheduleStop: stop} {
+		if at == nil {
+			delete(s.schedules[kind], campaignID)
+		} else {
+			s.schedules[kind][campaignID] = at.Unix()
+		}
+	}
+	return nil
+}
+
+func (s *MemoryQueueStore) DueSchedules(ctx context.Context, kind string, now time.Time) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sched := s.schedules[kind]
+	var out []string
+	for id, at := range sched {
+		if at <= now.Unix() {
+			out = append(out, id)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return sched[out[i]] < sched[out[j]] })
+	return out, nil
+}
+
+func (s *MemoryQueueStore) ClearSchedule(ctx context.Context, kind, campaignID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.schedules[kind], campaignID)
+	return nil
+}
+
+// PublishEvent has no subscribers in process; emit already logs every event.
+func (s *MemoryQueueStore) PublishEvent(ctx context.Context, ev CampaignEvent) error { return nil }
@@ -0,0 +1,7 @@
+package main
+
+import "testing"
+
+func TestMemoryQueueStore(t *testing.T) {
+	testQueueStore(t, func(t *testing.T) QueueStore { return NewMemoryQueueStore() })
+}
@@ -0,0 +1,933 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+var _ QueueStore = (*PostgresQueueStore)(nil)
+
+// PostgresQueueStore is the durable backend. Every job is a row in jobs:
+//
+//	queued      waiting; picked once next_attempt_at <= now() (retries and
+//	            locally scheduled jobs are queued rows with a future time)
+//	processing  leased to lease_owner until lease_until
+//	held        drained for an export that has not finished uploading
+//
+// Workers claim rows with SELECT ... FOR UPDATE SKIP LOCKED, so any number of
+// replicas can pop from the same campaign without handing a job out twice.
+// Sent and drained jobs are deleted; the counters live in progress.
+type PostgresQueueStore struct {
+	db *sql.DB
+	// poll is how often an idle PopToProcessing looks for work again.
+	poll time.Duration
+}
+
+func NewPostgresQueueStore(db *sql.DB) *PostgresQueueStore {
+	return &PostgresQueueStore{db: db, poll: 250 * time.Millisecond}
+}
+
+const postgresSchema = `
+CREATE TABLE IF NOT EXISTS campaigns (
+	id          text PRIMARY KEY,
+	registered  boolean NOT NULL DEFAULT false,
+	status      text,
+	rate_limit  bigint,
+	rate_burst  bigint,
+	rate_count  bigint NOT NULL DEFAULT 0,
+	count_until bigint NOT NULL DEFAULT 0, -- end of the rate_count window (unix ms)
+	message     text,
+	template    text,
+	columns     text,
+	def         text
+);
+
+CREATE TABLE IF NOT EXISTS jobs (
+	id              bigserial PRIMARY KEY,
+	campaign_id     text NOT NULL,
+	payload         text NOT NULL,
+	status          text NOT NULL DEFAULT 'queued',
+	attempts        integer NOT NULL DEFAULT 0,
+	next_attempt_at timestamptz NOT NULL DEFAULT now(),
+	lease_owner     text,
+	leased_at       timestamptz,
+	lease_until     timestamptz,
+	hold_token      text,
+	created_at      timestamptz NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS jobs_queued ON jobs (campaign_id, next_attempt_at, id) WHERE status = 'queued';
+CREATE INDEX IF NOT EXISTS jobs_processing ON jobs (campaign_id, lease_until) WHERE status = 'processing';
+
+CREATE TABLE IF NOT EXISTS dead_letters (
+	campaign_id text NOT NULL,
+	job_id      text NOT NULL,
+	payload     text NOT NULL,
+	failed_at   timestamptz NOT NULL,
+	PRIMARY KEY (campaign_id, job_id)
+);
+CREATE INDEX IF NOT EXISTS dead_letters_order ON dead_letters (campaign_id, failed_at, job_id);
+
+CREATE TABLE IF NOT EXISTS deliveries (
+	campaign_id  text NOT NULL,
+	email        text NOT NULL,
+	job_id       text NOT NULL,
+	provider     text NOT NULL,
+	delivered_at timestamptz NOT NULL,
+	PRIMARY KEY (campaign_id, email)
+);
+
+CREATE TABLE IF NOT EXISTS progress (
+	campaign_id text NOT NULL,
+	field       text NOT NULL,
+	value       text NOT NULL,
+	PRIMARY KEY (campaign_id, field)
+);
+
+CREATE TABLE IF NOT EXISTS rate_limits (
+	scope text PRIMARY KEY,
+	tpm   bigint NOT NULL,
+	burst bigint NOT NULL DEFAULT 0
+);
+
+CREATE TABLE IF NOT EXISTS rate_tats (
+	scope text PRIMARY KEY,
+	tat   bigint NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS schedules (
+	kind        text NOT NULL,
+	campaign_id text NOT NULL,
+	at          bigint NOT NULL,
+	PRIMARY KEY (kind, campaign_id)
+);
+`
+
+// Migrate creates the tables if they do not exist yet.
+func (s *PostgresQueueStore) Migrate(ctx context.Context) error {
+	_, err := s.db.ExecContext(ctx, postgresSchema)
+	return err
+}
+
+func (s *PostgresQueueStore) eventsChannel() string { return "campaigns_events" }
+
+// inTx runs fn in a transaction, committing if it returns nil.
+func (s *PostgresQueueStore) inTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// scanStrings reads a single text column from every row and closes rows.
+func scanStrings(rows *sql.Rows) ([]string, error) {
+	defer rows.Close()
+	out := make([]string, 0)
+	for rows.Next() {
+		var v string
+		if err := rows.Scan(&v); err != nil {
+			return nil, err
+		}
+		out = append(out, v)
+	}
+	return out, rows.Err()
+}
+
+// setCampaign upserts one column of the campaign row. col is always a literal
+// from this file, never user input.
+func (s *PostgresQueueStore) setCampaign(ctx context.Context, campaignID, col string, val any) error {
+	_, err := s.db.ExecContext(ctx,
+		`INSERT INTO campaigns (id, `+col+`) VALUES ($1, $2)
+		 ON CONFLICT (id) DO UPDATE SET `+col+` = EXCLUDED.`+col, campaignID, val)
+	return err
+}
+
+// getCampaign reads one nullable column; missing rows read as NULL.
+func (s *PostgresQueueStore) getCampaign(ctx context.Context, campaignID, col string, dst any) error {
+	err := s.db.QueryRowContext(ctx, `SELECT `+col+` FROM campaigns WHERE id = $1`, campaignID).Scan(dst)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	return err
+}
+
+func (s *PostgresQueueStore) Enqueue(ctx context.Context, campaignID string, payload any) error {
+	return s.EnqueueBatch(ctx, campaignID, []any{payload})
+}
+
+// EnqueueBatch inserts every payload with a single statement.
+func (s *PostgresQueueStore) EnqueueBatch(ctx context.Context, campaignID string, payloads []any) error {
+	if len(payloads) == 0 {
+		return nil
+	}
+	raws := make([]string, 0, len(payloads))
+	for _, p := range payloads {
+		b, err := json.Marshal(p)
+		if err != nil {
+			return err
+		}
+		raws = append(raws, string(b))
+	}
+	_, err := s.db.ExecContext(ctx,
+		`INSERT INTO jobs (campaign_id, payload) SELECT $1, unnest($2::text[])`, campaignID, pq.Array(raws))
+	return err
+}
+
+// PopToProcessing claims the oldest due job and leases it to workerID. There
+// is no blocking pop in Postgres, so an empty queue is polled until timeout.
+func (s *PostgresQueueStore) PopToProcessing(ctx context.Context, campaignID, workerID string, lease, timeout time.Duration) (string, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		var raw string
+		err := s.db.QueryRowContext(ctx, `
+			UPDATE jobs SET status = 'processing', lease_owner = $2,
+			       leased_at = now(), lease_until = now() + $3::bigint * interval '1 millisecond'
+			WHERE id = (
+				SELECT id FROM jobs
+				WHERE campaign_id = $1 AND status = 'queued' AND next_attempt_at <= now()
+				ORDER BY next_attempt_at, id
+				LIMIT 1
+				FOR UPDATE SKIP LOCKED)
+			RETURNING payload`, campaignID, workerID, lease.Milliseconds()).Scan(&raw)
+		if err == nil {
+			return raw, nil
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return "", err
+		}
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return "", nil
+		}
+		if wait > s.poll {
+			wait = s.poll
+		}
+		sleepCtx(ctx, wait)
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
+	}
+}
+
+// processingJob selects one in-flight row holding payload.
+const processingJob = `SELECT id FROM jobs WHERE campaign_id = $1 AND status = 'processing' AND payload = $2 LIMIT 1`
+
+func (s *PostgresQueueStore) RemoveFromProcessing(ctx context.Context, campaignID, payload string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM jobs WHERE id = (`+processingJob+`)`, campaignID, payload)
+	return err
+}
+
+func (s *PostgresQueueStore) ExtendLease(ctx context.Context, campaignID, payload, workerID string, lease time.Duration) (bool, error) {
+	res, err := s.db.ExecContext(ctx, `
+		UPDATE jobs SET lease_until = now() + $4::bigint * interval '1 millisecond'
+		WHERE id = (
+			SELECT id FROM jobs
+			WHERE campaign_id = $1 AND status = 'processing' AND payload = $2 AND lease_owner = $3
+			LIMIT 1)`,
+		campaignID, payload, workerID, lease.Milliseconds())
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// RequeueExpired puts up to max jobs whose lease ran out back in the queue.
+func (s *PostgresQueueStore) RequeueExpired(ctx context.Context, campaignID string, lease time.Duration, max int) (int, error) {
+	res, err := s.db.ExecContext(ctx, `
+		UPDATE jobs SET status = 'queued', next_attempt_at = now(),
+		       lease_owner = NULL, leased_at = NULL, lease_until = NULL
+		WHERE id IN (
+			SELECT id FROM jobs
+			WHERE campaign_id = $1 AND status = 'processing' AND lease_until <= now()
+			ORDER BY lease_until
+			LIMIT $2
+			FOR UPDATE SKIP LOCKED)`, campaignID, max)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+// DrainPending deletes and returns up to max unsent jobs: due ones first, then
+// in-flight, then those scheduled for later. It waits for rows a worker is
+// claiming rather than skipping them, so repeated calls leave nothing behind.
+func (s *PostgresQueueStore) DrainPending(ctx context.Context, campaignID string, max int) ([]string, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		DELETE FROM jobs WHERE id IN (`+pendingJobs+`)
+		RETURNING payload`, campaignID, max)
+	if err != nil {
+		return nil, err
+	}
+	return scanStrings(rows)
+}
+
+// pendingJobs picks up to $2 unsent jobs in drain order: due, in flight, then
+// scheduled. Held rows are already drained.
+const pendingJobs = `
+	SELECT id FROM jobs WHERE campaign_id = $1 AND status <> 'held'
+	ORDER BY (status = 'queued' AND next_attempt_at <= now()) DESC, status = 'processing' DESC, next_attempt_at, id
+	LIMIT $2
+	FOR UPDATE`
+
+// HoldPending marks the drained rows 'held' under token instead of deleting
+// them.
+func (s *PostgresQueueStore) HoldPending(ctx context.Context, campaignID, token string, max int) ([]string, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		UPDATE jobs SET status = 'held', hold_token = $3, lease_owner = NULL, leased_at = NULL, lease_until = NULL
+		WHERE id IN (`+pendingJobs+`)
+		RETURNING payload`, campaignID, max, token)
+	if err != nil {
+		return nil, err
+	}
+	return scanStrings(rows)
+}
+
+func (s *PostgresQueueStore) ReleaseHeld(ctx context.Context, campaignID, token string, requeue bool) (int, error) {
+	query := `DELETE FROM jobs WHERE campaign_id = $1 AND status = 'held' AND hold_token = $2`
+	if requeue {
+		query = `UPDATE jobs SET status = 'queued', hold_token = NULL, next_attempt_at = now()
+			WHERE campaign_id = $1 AND status = 'held' AND hold_token = $2`
+	}
+	res, err := s.db.ExecContext(ctx, query, campaignID, token)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+func (s *PostgresQueueStore) HeldTokens(ctx context.Context, campaignID string) ([]string, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT DISTINCT hold_token FROM jobs WHERE campaign_id = $1 AND status = 'held' ORDER BY hold_token`, campaignID)
+	if err != nil {
+		return nil, err
+	}
+	return scanStrings(rows)
+}
+
+// Retries are queued rows that only become due at unixTs.
+func (s *PostgresQueueStore) AddRetry(ctx context.Context, campaignID string, unixTs int64, payload string) error {
+	return s.AddRetryBatch(ctx, campaignID, []retryItem{{At: unixTs, Payload: payload}})
+}
+
+func (s *PostgresQueueStore) AddRetryBatch(ctx context.Context, campaignID string, items []retryItem) error {
+	if len(items) == 0 {
+		return nil
+	}
+	raws := make([]string, 0, len(items))
+	ats := make([]int64, 0, len(items))
+	for _, it := range items {
+		raws = append(raws, it.Payload)
+		ats = append(ats, it.At)
+	}
+	// attempts mirrors the payload's count of failed sends, so a requeued
+	// lease or a deferral leaves it where it was.
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO jobs (campaign_id, payload, attempts, next_attempt_at)
+		SELECT $1, p, COALESCE((p::jsonb->>'attempts')::integer, 0), to_timestamp(a)
+		FROM unnest($2::text[], $3::bigint[]) AS t(p, a)`,
+		campaignID, pq.Array(raws), pq.Array(ats))
+	return err
+}
+
+// PromoteDueRetries has nothing to move: a retry is picked up by
+// PopToProcessing as soon as its next_attempt_at passes.
+func (s *PostgresQueueStore) PromoteDueRetries(ctx context.Context, campaignID string, now int64, max int) (int, error) {
+	return 0, nil
+}
+
+// Retries lists queued rows that are not due yet: retries and deferred jobs.
+func (s *PostgresQueueStore) Retries(ctx context.Context, campaignID string, offset, limit int) ([]retryItem, int64, error) {
+	const pending = `FROM jobs WHERE campaign_id = $1 AND status = 'queued' AND next_attempt_at > now()`
+	var total int64
+	if err := s.db.QueryRowContext(ctx, `SELECT count(*) `+pending, campaignID).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT extract(epoch FROM next_attempt_at)::bigint, payload `+pending+`
+		ORDER BY next_attempt_at, id OFFSET $2 LIMIT $3`, campaignID, offset, limit)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	out := make([]retryItem, 0)
+	for rows.Next() {
+		var it retryItem
+		if err := rows.Scan(&it.At, &it.Payload); err != nil {
+			return nil, 0, err
+		}
+		out = append(out, it)
+	}
+	return out, total, rows.Err()
+}
+
+func (s *PostgresQueueStore) AddDeadLetter(ctx context.Context, campaignID, jobID, payload string, at time.Time) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO dead_letters (campaign_id, job_id, payload, failed_at) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (campaign_id, job_id) DO UPDATE SET payload = EXCLUDED.payload, failed_at = EXCLUDED.failed_at`,
+		campaignID, jobID, payload, at)
+	return err
+}
+
+func (s *PostgresQueueStore) DeadLetters(ctx context.Context, campaignID string, offset, limit int) ([]string, int64, error) {
+	var total int64
+	if err := s.db.QueryRowContext(ctx, `SELECT count(*) FROM dead_letters WHERE campaign_id = $1`, campaignID).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT payload FROM dead_letters WHERE campaign_id = $1
+		ORDER BY failed_at, job_id OFFSET $2 LIMIT $3`, campaignID, offset, limit)
+	if err != nil {
+		return nil, 0, err
+	}
+	out, err := scanStrings(rows)
+	return out, total, err
+}
+
+// RecordDeliveries upserts by email; a later delivery to the same address
+// replaces the earlier one.
+func (s *PostgresQueueStore) RecordDeliveries(ctx context.Context, campaignID string, ds []Delivery) error {
+	if len(ds) == 0 {
+		return nil
+	}
+	emails := make([]string, 0, len(ds))
+	jobIDs := make([]string, 0, len(ds))
+	providers := make([]string, 0, len(ds))
+	ats := make([]int64, 0, len(ds)) // unix ms
+	for _, d := range ds {
+		emails = append(emails, d.Email)
+		jobIDs = append(jobIDs, d.JobID)
+		providers = append(providers, d.Provider)
+		ats = append(ats, d.At.UnixMilli())
+	}
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO deliveries (campaign_id, email, job_id, provider, delivered_at)
+		SELECT DISTINCT ON (e) $1, e, j, p, to_timestamp(a / 1000.0)
+		FROM unnest($2::text[], $3::text[], $4::text[], $5::bigint[]) WITH ORDINALITY AS t(e, j, p, a, n)
+		ORDER BY e, n DESC
+		ON CONFLICT (campaign_id, email) DO UPDATE
+		SET job_id = EXCLUDED.job_id, provider = EXCLUDED.provider, delivered_at = EXCLUDED.delivered_at`,
+		campaignID, pq.Array(emails), pq.Array(jobIDs), pq.Array(providers), pq.Array(ats))
+	return err
+}
+
+func (s *PostgresQueueStore) GetDelivery(ctx context.Context, campaignID, email string) (Delivery, error) {
+	d := Delivery{Email: email}
+	err := s.db.QueryRowContext(ctx, `
+		SELECT job_id, provider, delivered_at FROM deliveries WHERE campaign_id = $1 AND email = $2`,
+		campaignID, email).Scan(&d.JobID, &d.Provider, &d.At)
+	if err == sql.ErrNoRows {
+		return d, ErrNotFound
+	}
+	d.At = d.At.UTC()
+	return d, err
+}
+
+func (s *PostgresQueueStore) TakeDeadLetters(ctx context.Context, campaignID string, jobIDs []string, max int) ([]string, error) {
+	var rows *sql.Rows
+	var err error
+	if len(jobIDs) > 0 {
+		rows, err = s.db.QueryContext(ctx, `
+			DELETE FROM dead_letters WHERE campaign_id = $1 AND job_id = ANY($2)
+			RETURNING payload`, campaignID, pq.Array(jobIDs))
+	} else {
+		rows, err = s.db.QueryContext(ctx, `
+			DELETE FROM dead_letters WHERE campaign_id = $1 AND job_id IN (
+				SELECT job_id FROM dead_letters WHERE campaign_id = $1
+				ORDER BY failed_at, job_id LIMIT $2
+				FOR UPDATE SKIP LOCKED)
+			RETURNING payload`, campaignID, max)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return scanStrings(rows)
+}
+
+func (s *PostgresQueueStore) InitProgress(ctx context.Context, campaignID string, total int64) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO progress (campaign_id, field, value)
+		VALUES ($1, 'total', $2), ($1, 'sent', '0'), ($1, 'failed', '0')
+		ON CONFLICT (campaign_id, field) DO UPDATE
+		SET value = CASE WHEN EXCLUDED.field = 'total' THEN EXCLUDED.value ELSE progress.value END`,
+		campaignID, strconv.FormatInt(total, 10))
+	return err
+}
+
+func (s *PostgresQueueStore) IncrProgress(ctx context.Context, campaignID, field string, delta int64) (int64, error) {
+	var n int64
+	err := s.db.QueryRowContext(ctx, `
+		INSERT INTO progress (campaign_id, field, value) VALUES ($1, $2, $3::bigint::text)
+		ON CONFLICT (campaign_id, field) DO UPDATE SET value = (progress.value::bigint + $3::bigint)::text
+		RETURNING value::bigint`, campaignID, field, delta).Scan(&n)
+	return n, err
+}
+
+func (s *PostgresQueueStore) GetProgress(ctx context.Context, campaignID string) (map[string]string, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT field, value FROM progress WHERE campaign_id = $1`, campaignID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make(map[string]string)
+	for rows.Next() {
+		var f, v string
+		if err := rows.Scan(&f, &v); err != nil {
+			return nil, err
+		}
+		out[f] = v
+	}
+	return out, rows.Err()
+}
+
+func (s *PostgresQueueStore) DeleteProgress(ctx context.Context, campaignID, field string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM progress WHERE campaign_id = $1 AND field = $2`, campaignID, field)
+	return err
+}
+
+// CompleteIfDone locks the campaign row so concurrent reconcilers agree on
+// who completed it.
+func (s *PostgresQueueStore) CompleteIfDone(ctx context.Context, campaignID string, finishedAt time.Time) (bool, error) {
+	done := false
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		var status sql.NullString
+		err := tx.QueryRowContext(ctx, `SELECT status FROM campaigns WHERE id = $1 FOR UPDATE`, campaignID).Scan(&status)
+		if errors.Is(err, sql.ErrNoRows) || (err == nil && status.String != StateRunning) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var pending bool
+		if err := tx.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM jobs WHERE campaign_id = $1)`, campaignID).Scan(&pending); err != nil || pending {
+			return err
+		}
+		var total sql.NullInt64
+		var finished int64
+		err = tx.QueryRowContext(ctx, `
+			SELECT max(value::bigint) FILTER (WHERE field = 'total'),
+			       coalesce(sum(value::bigint) FILTER (WHERE field IN ('sent', 'failed', 'cancelled')), 0)
+			FROM progress WHERE campaign_id = $1`, campaignID).Scan(&total, &finished)
+		if err != nil || !total.Valid || finished < total.Int64 {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, `UPDATE campaigns SET status = $2 WHERE id = $1`, campaignID, StateCompleted); err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO progress (campaign_id, field, value) VALUES ($1, 'finished_at', $2)
+			ON CONFLICT (campaign_id, field) DO UPDATE SET value = EXCLUDED.value`,
+			campaignID, finishedAt.Format(time.RFC3339))
+		done = err == nil
+		return err
+	})
+	return done, err
+}
+
+func (s *PostgresQueueStore) SetStatus(ctx context.Context, campaignID, status string) error {
+	return s.setCampaign(ctx, campaignID, "status", status)
+}
+
+func (s *PostgresQueueStore) GetStatus(ctx context.Context, campaignID string) (string, error) {
+	var status sql.NullString
+	if err := s.getCampaign(ctx, campaignID, "status", &status); err != nil {
+		return "", err
+	}
+	if !status.Valid {
+		return "", ErrNotFound
+	}
+	return status.String, nil
+}
+
+func (s *PostgresQueueStore) TransitionStatus(ctx context.Context, campaignID string, from []string, to string) (bool, string, error) {
+	var ok bool
+	var cur sql.NullString
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, `INSERT INTO campaigns (id) VALUES ($1) ON CONFLICT (id) DO NOTHING`, campaignID); err != nil {
+			return err
+		}
+		if err := tx.QueryRowContext(ctx, `SELECT status FROM campaigns WHERE id = $1 FOR UPDATE`, campaignID).Scan(&cur); err != nil {
+			return err
+		}
+		for _, f := range from {
+			if f == cur.String {
+				ok = true
+				_, err := tx.ExecContext(ctx, `UPDATE campaigns SET status = $2 WHERE id = $1`, campaignID, to)
+				return err
+			}
+		}
+		return nil
+	})
+	return ok, cur.String, err
+}
+
+func (s *PostgresQueueStore) SetRateLimit(ctx context.Context, campaignID string, limit int64) error {
+	return s.setCampaign(ctx, campaignID, "rate_limit", limit)
+}
+
+func (s *PostgresQueueStore) GetRateLimit(ctx context.Context, campaignID string) (int64, error) {
+	var v sql.NullInt64
+	if err := s.getCampaign(ctx, campaignID, "rate_limit", &v); err != nil {
+		return 0, err
+	}
+	if !v.Valid {
+		return 0, ErrNotFound
+	}
+	return v.Int64, nil
+}
+
+func (s *PostgresQueueStore) SetRateBurst(ctx context.Context, campaignID string, burst int64) error {
+	return s.setCampaign(ctx, campaignID, "rate_burst", burst)
+}
+
+func (s *PostgresQueueStore) GetRateBurst(ctx context.Context, campaignID string) (int64, error) {
+	var v sql.NullInt64
+	if err := s.getCampaign(ctx, campaignID, "rate_burst", &v); err != nil {
+		return 0, err
+	}
+	if !v.Valid {
+		return 0, ErrNotFound
+	}
+	return v.Int64, nil
+}
+
+func (s *PostgresQueueStore) SetScopedLimit(ctx context.Context, scope string, limit RateLimit) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO rate_limits (scope, tpm, burst) VALUES ($1, $2, $3)
+		ON CONFLICT (scope) DO UPDATE SET tpm = EXCLUDED.tpm, burst = EXCLUDED.burst`,
+		scope, limit.TPM, limit.Burst)
+	return err
+}
+
+func (s *PostgresQueueStore) DeleteScopedLimit(ctx context.Context, scope string) error {
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM rate_limits WHERE scope = $1`, scope); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(ctx, `DELETE FROM rate_tats WHERE scope = $1`, scope)
+		return err
+	})
+}
+
+func (s *PostgresQueueStore) GetScopedLimits(ctx context.Context) (map[string]RateLimit, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT scope, tpm, burst FROM rate_limits`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make(map[string]RateLimit)
+	for rows.Next() {
+		var scope string
+		var l RateLimit
+		if err := rows.Scan(&scope, &l.TPM, &l.Burst); err != nil {
+			return nil, err
+		}
+		out[scope] = l
+	}
+	return out, rows.Err()
+}
+
+// TakeRate is the same all-or-nothing GCRA as gcraScript. The TAT rows are
+// locked in scope order (so two senders can't deadlock) and the database
+// clock is used so replicas agree.
+func (s *PostgresQueueStore) TakeRate(ctx context.Context, buckets []rateBucket) (bool, time.Duration, int, error) {
+	scopes := make([]string, 0, len(buckets))
+	for _, b := range buckets {
+		scopes = append(scopes, b.Scope)
+	}
+	sorted := append([]string(nil), scopes...)
+	sort.Strings(sorted)
+
+	var ok bool
+	var wait int64
+	worst := 0
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		var now int64
+		if err := tx.QueryRowContext(ctx, `SELECT (extract(epoch FROM clock_timestamp()) * 1000)::bigint`).Scan(&now); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO rate_tats (scope, tat) SELECT unnest($1::text[]), 0
+			ON CONFLICT (scope) DO NOTHING`, pq.Array(sorted)); err != nil {
+			return err
+		}
+		rows, err := tx.QueryContext(ctx, `SELECT scope, tat FROM rate_tats WHERE scope = ANY($1) ORDER BY scope FOR UPDATE`, pq.Array(sorted))
+		if err != nil {
+			return err
+		}
+		current := make(map[string]int64, len(sorted))
+		for rows.Next() {
+			var scope string
+			var tat int64
+			if err := rows.Scan(&scope, &tat); err != nil {
+				rows.Close()
+				return err
+			}
+			current[scope] = tat
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		tats := make([]int64, len(buckets))
+		for i, b := range buckets {
+			interval := b.Limit.interval().Milliseconds()
+			if interval < 1 {
+				interval = 1
+			}
+			tat := current[b.Scope]
+			if tat < now {
+				tat = now
+			}
+			newTAT := tat + interval
+			if allowAt := newTAT - interval*b.Limit.Burst; allowAt-now > wait {
+				wait, worst = allowAt-now, i
+			}
+			tats[i] = newTAT
+		}
+		if wait > 0 {
+			return nil
+		}
+		ok = true
+		_, err = tx.ExecContext(ctx, `
+			UPDATE rate_tats SET tat = t.tat FROM unnest($1::text[], $2::bigint[]) AS t(scope, tat)
+			WHERE rate_tats.scope = t.scope`, pq.Array(scopes), pq.Array(tats))
+		return err
+	})
+	if err != nil {
+		return false, 0, 0, err
+	}
+	if !ok {
+		return false, time.Duration(wait) * time.Millisecond, worst, nil
+	}
+	return true, 0, 0, nil
+}
+
+func (s *PostgresQueueStore) RateAvailable(ctx context.Context, scope string, limit RateLimit) (int64, error) {
+	var backlog int64
+	err := s.db.QueryRowContext(ctx, `
+		SELECT tat - (extract(epoch FROM clock_timestamp()) * 1000)::bigint FROM rate_tats WHERE scope = $1`, scope).Scan(&backlog)
+	if errors.Is(err, sql.ErrNoRows) {
+		return limit.Burst, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	interval := limit.interval().Milliseconds()
+	if interval < 1 || backlog <= 0 {
+		return limit.Burst, nil
+	}
+	avail := limit.Burst - (backlog+interval-1)/interval
+	if avail < 0 {
+		avail = 0
+	}
+	return avail, nil
+}
+
+// IncrRateCount counts one admitted send in a fixed one-minute window kept on
+// the campaign row; it only feeds tpm_used.
+func (s *PostgresQueueStore) IncrRateCount(ctx context.Context, campaignID string) (int64, error) {
+	var n int64
+	err := s.db.QueryRowContext(ctx, `
+		INSERT INTO campaigns (id, rate_count, count_until)
+		VALUES ($1, 1, (extract(epoch FROM clock_timestamp()) * 1000)::bigint + 60000)
+		ON CONFLICT (id) DO UPDATE SET
+			rate_count  = CASE WHEN campaigns.count_until > (extract(epoch FROM clock_timestamp()) * 1000)::bigint
+			                   THEN campaigns.rate_count + 1 ELSE 1 END,
+			count_until = CASE WHEN campaigns.count_until > (extract(epoch FROM clock_timestamp()) * 1000)::bigint
+			                   THEN campaigns.count_until ELSE EXCLUDED.count_until END
+		RETURNING rate_count`, campaignID).Scan(&n)
+	return n, err
+}
+
+func (s *PostgresQueueStore) GetRateCount(ctx context.Context, campaignID string) (int64, error) {
+	var n int64
+	err := s.db.QueryRowContext(ctx, `
+		SELECT CASE WHEN count_until > (extract(epoch FROM clock_timestamp()) * 1000)::bigint THEN rate_count ELSE 0 END
+		FROM campaigns WHERE id = $1`, campaignID).Scan(&n)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	return n, err
+}
+
+// Message, template, columns and definition are JSON text columns on the
+// campaign row; NULL means not set.
+func (s *PostgresQueueStore) SetMessage(ctx context.Context, campaignID string, msg *Message) error {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return s.setCampaign(ctx, campaignID, "message", string(b))
+}
+
+func (s *PostgresQueueStore) GetMessage(ctx context.Context, campaignID string) (*Message, error) {
+	var raw sql.NullString
+	if err := s.getCampaign(ctx, campaignID, "message", &raw); err != nil || !raw.Valid {
+		return nil, err
+	}
+	var msg Message
+	if err := json.Unmarshal([]byte(raw.String), &msg); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+func (s *PostgresQueueStore) SetTemplate(ctx context.Context, campaignID string, t *Template) error {
+	b, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	return s.setCampaign(ctx, campaignID, "template", string(b))
+}
+
+func (s *PostgresQueueStore) GetTemplate(ctx context.Context, campaignID string) (string, error) {
+	var raw sql.NullString
+	err := s.getCampaign(ctx, campaignID, "template", &raw)
+	return raw.String, err
+}
+
+func (s *PostgresQueueStore) SetColumns(ctx context.Context, campaignID string, columns []string) error {
+	b, err := json.Marshal(columns)
+	if err != nil {
+		return err
+	}
+	return s.setCampaign(ctx, campaignID, "columns", string(b))
+}
+
+func (s *PostgresQueueStore) GetColumns(ctx context.Context, campaignID string) ([]string, error) {
+	var raw sql.NullString
+	if err := s.getCampaign(ctx, campaignID, "columns", &raw); err != nil || !raw.Valid {
+		return nil, err
+	}
+	var cols []string
+	return cols, json.Unmarshal([]byte(raw.String), &cols)
+}
+
+// CreateCampaignDef returns false if the ID already has a definition.
+func (s *PostgresQueueStore) CreateCampaignDef(ctx context.Context, def *CampaignDef) (bool, error) {
+	b, err := json.Marshal(def)
+	if err != nil {
+		return false, err
+	}
+	res, err := s.db.ExecContext(ctx, `
+		INSERT INTO campaigns (id, def) VALUES ($1, $2)
+		ON CONFLICT (id) DO UPDATE SET def = EXCLUDED.def WHERE campaigns.def IS NULL`, def.ID, string(b))
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+func (s *PostgresQueueStore) SaveCampaignDef(ctx context.Context, def *CampaignDef) error {
+	b, err := json.Marshal(def)
+	if err != nil {
+		return err
+	}
+	return s.setCampaign(ctx, def.ID, "def", string(b))
+}
+
+func (s *PostgresQueueStore) GetCampaignDef(ctx context.Context, campaignID string) (*CampaignDef, error) {
+	var raw sql.NullString
+	if err := s.getCampaign(ctx, campaignID, "def", &raw); err != nil || !raw.Valid {
+		return nil, err
+	}
+	var def CampaignDef
+	if err := json.Unmarshal([]byte(raw.String), &def); err != nil {
+		return nil, err
+	}
+	return &def, nil
+}
+
+// DeleteCampaign drops every row belonging to the campaign.
+func (s *PostgresQueueStore) DeleteCampaign(ctx context.Context, campaignID string) error {
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		for _, q := range []string{
+			`DELETE FROM jobs WHERE campaign_id = $1`,
+			`DELETE FROM progress WHERE campaign_id = $1`,
+			`DELETE FROM dead_letters WHERE campaign_id = $1`,
+			`DELETE FROM deliveries WHERE campaign_id = $1`,
+			`DELETE FROM schedules WHERE campaign_id = $1`,
+			`DELETE FROM campaigns WHERE id = $1`,
+		} {
+			if _, err := tx.ExecContext(ctx, q, campaignID); err != nil {
+				return err
+			}
+		}
+		_, err := tx.ExecContext(ctx, `DELETE FROM rate_tats WHERE scope = $1`, campaignScope(campaignID))
+		return err
+	})
+}
+
+func (s *PostgresQueueStore) RegisterCampaign(ctx context.Context, campaignID string) {
+	_ = s.setCampaign(ctx, campaignID, "registered", true)
+}
+
+func (s *PostgresQueueStore) ListCampaigns(ctx context.Context) ([]string, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT id FROM campaigns WHERE registered`)
+	if err != nil {
+		return nil, err
+	}
+	return scanStrings(rows)
+}
+
+// Schedules: one row per (kind, campaign), at in unix seconds.
+func (s *PostgresQueueStore) SetSchedule(ctx context.Context, campaignID string, start, stop *time.Time) error {
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		for kind, at := range map[string]*time.Time{scheduleStart: start, scheduleStop: stop} {
+			var err error
+			if at == nil {
+				_, err = tx.ExecContext(ctx, `DELETE FROM schedules WHERE kind = $1 AND campaign_id = $2`, kind, campaignID)
+			} else {
+				_, err = tx.ExecContext(ctx, `
+					INSERT INTO schedules (kind, campaign_id, at) VALUES ($1, $2, $3)
+					ON CONFLICT (kind, campaign_id) DO UPDATE SET at = EXCLUDED.at`, kind, campaignID, at.Unix())
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *PostgresQueueStore) DueSchedules(ctx context.Context, kind string, now time.Time) ([]string, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT campaign_id FROM schedules WHERE kind = $1 AND at <= $2 ORDER BY at`, kind, now.Unix())
+	if err != nil {
+		return nil, err
+	}
+	return scanStrings(rows)
+}
+
+func (s *PostgresQueueStore) ClearSchedule(ctx context.Context, kind, campaignID string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM schedules WHERE kind = $1 AND campaign_id = $2`, kind, campaignID)
+	return err
+}
+
+// PublishEvent sends the event with NOTIFY; LISTEN campaigns_events to follow.
+func (s *PostgresQueueStore) PublishEvent(ctx context.Context, ev CampaignEvent) error {
+	b, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	if _, err := s.db.ExecContext(ctx, `SELECT pg_notify($1, $2)`, s.eventsChannel(), string(b)); err != nil {
+		return fmt.Errorf("notify: %w", err)
+	}
+	return nil
+}
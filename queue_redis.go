@@ -3,39 +3,158 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"time"
 
 	"github.com/redis/go-redis/v9"
 )
 
+var _ QueueStore = (*RedisQueueStore)(nil)
+
 type RedisQueueStore struct {
 	rdb *redis.Client
 }
 
 func NewRedisQueueStore(rdb *redis.Client) *RedisQueueStore { return &RedisQueueStore{rdb: rdb} }
 
-func (s *RedisQueueStore) queueKey(campaignID string) string      { return "campaign:" + campaignID + ":queue" }
-func (s *RedisQueueStore) processingKey(campaignID string) string { return "campaign:" + campaignID + ":processing" }
-func (s *RedisQueueStore) progressKey(campaignID string) string   { return "campaign:" + campaignID + ":progress" }
-func (s *RedisQueueStore) statusKey(campaignID string) string     { return "campaign:" + campaignID + ":status" }
-func (s *RedisQueueStore) rateLimitKey(campaignID string) string  { return "rate_limit:campaign:" + campaignID }
-func (s *RedisQueueStore) rateCountKey(campaignID string) string  { return "rate_limit_count:campaign:" + campaignID }
-func (s *RedisQueueStore) retryKey(campaignID string) string      { return "campaign:" + campaignID + ":retry" }
-func (s *RedisQueueStore) campaignsSet() string                   { return "campaigns:list" }
+func (s *RedisQueueStore) queueKey(campaignID string) string {
+	return "campaign:" + campaignID + ":queue"
+}
+func (s *RedisQueueStore) processingKey(campaignID string) string {
+	return "campaign:" + campaignID + ":processing"
+}
+func (s *RedisQueueStore) leaseKey(campaignID string) string {
+	return "campaign:" + campaignID + ":leases"
+}
+func (s *RedisQueueStore) leaseOwnerKey(campaignID string) string {
+	return "campaign:" + campaignID + ":lease_owner"
+}
+func (s *RedisQueueStore) progressKey(campaignID string) string {
+	return "campaign:" + campaignID + ":progress"
+}
+func (s *RedisQueueStore) statusKey(campaignID string) string {
+	return "campaign:" + campaignID + ":status"
+}
+func (s *RedisQueueStore) rateLimitKey(campaignID string) string {
+	return "rate_limit:campaign:" + campaignID
+}
+func (s *RedisQueueStore) rateBurstKey(campaignID string) string {
+	return "rate_limit_burst:campaign:" + campaignID
+}
+func (s *RedisQueueStore) rateTATKey(scope string) string { return "rate_limit_tat:" + scope }
+func (s *RedisQueueStore) rateCountKey(campaignID string) string {
+	return "rate_limit_count:campaign:" + campaignID
+}
+func (s *RedisQueueStore) scopedLimitsKey() string { return "rate_limits" }
+func (s *RedisQueueStore) messageKey(campaignID string) string {
+	return "campaign:" + campaignID + ":message"
+}
+func (s *RedisQueueStore) templateKey(campaignID string) string {
+	return "campaign:" + campaignID + ":template"
+}
+func (s *RedisQueueStore) columnsKey(campaignID string) string {
+	return "campaign:" + campaignID + ":columns"
+}
+func (s *RedisQueueStore) retryKey(campaignID string) string {
+	return "campaign:" + campaignID + ":retry"
+}
+func (s *RedisQueueStore) defKey(campaignID string) string { return "campaign:" + campaignID + ":def" }
+func (s *RedisQueueStore) deadKey(campaignID string) string {
+	return "campaign:" + campaignID + ":dead"
+}
+func (s *RedisQueueStore) deadIndexKey(campaignID string) string {
+	return "campaign:" + campaignID + ":dead_index"
+}
+func (s *RedisQueueStore) heldKey(campaignID, token string) string {
+	return "campaign:" + campaignID + ":held:" + token
+}
+func (s *RedisQueueStore) heldTokensKey(campaignID string) string {
+	return "campaign:" + campaignID + ":held_tokens"
+}
+func (s *RedisQueueStore) deliveredKey(campaignID string) string {
+	return "campaign:" + campaignID + ":delivered"
+}
+func (s *RedisQueueStore) eventsChannel() string          { return "campaigns:events" }
+func (s *RedisQueueStore) scheduleKey(kind string) string { return "campaigns:scheduled_" + kind }
+func (s *RedisQueueStore) campaignsSet() string           { return "campaigns:list" }
 
 func (s *RedisQueueStore) Enqueue(ctx context.Context, campaignID string, payload any) error {
 	b, _ := json.Marshal(payload)
 	return s.rdb.LPush(ctx, s.queueKey(campaignID), b).Err()
 }
 
-// BRPOPLPUSH pattern (reliable): pop from main queue, push into processing list
-func (s *RedisQueueStore) PopToProcessing(ctx context.Context, campaignID string, timeout time.Duration) (string, error) {
-	return s.rdb.BRPopLPush(ctx, s.queueKey(campaignID), s.processingKey(campaignID), timeout).Result()
+// EnqueueBatch pushes many payloads with a single variadic LPUSH (one round trip).
+func (s *RedisQueueStore) EnqueueBatch(ctx context.Context, campaignID string, payloads []any) error {
+	if len(payloads) == 0 {
+		return nil
+	}
+	vals := make([]any, 0, len(payloads))
+	for _, p := range payloads {
+		b, err := json.Marshal(p)
+		if err != nil {
+			return err
+		}
+		vals = append(vals, b)
+	}
+	return s.rdb.LPush(ctx, s.queueKey(campaignID), vals...).Err()
+}
+
+// BRPOPLPUSH pattern (reliable): pop from main queue, push into processing list,
+// then take a lease on the item. The lease ZSET is scored by deadline (unix ms)
+// and the owner hash records "workerID|claimedAtMs".
+func (s *RedisQueueStore) PopToProcessing(ctx context.Context, campaignID, workerID string, lease, timeout time.Duration) (string, error) {
+	var raw string
+	var err error
+	if timeout > 0 {
+		raw, err = s.rdb.BRPopLPush(ctx, s.queueKey(campaignID), s.processingKey(campaignID), timeout).Result()
+	} else {
+		// BRPOPLPUSH with 0 would block forever
+		raw, err = s.rdb.RPopLPush(ctx, s.queueKey(campaignID), s.processingKey(campaignID)).Result()
+	}
+	if err == redis.Nil {
+		return "", nil // timed out with nothing queued
+	}
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	pipe := s.rdb.TxPipeline()
+	pipe.ZAdd(ctx, s.leaseKey(campaignID), redis.Z{Score: float64(now.Add(lease).UnixMilli()), Member: raw})
+	pipe.HSet(ctx, s.leaseOwnerKey(campaignID), raw, fmt.Sprintf("%s|%d", workerID, now.UnixMilli()))
+	_, err = pipe.Exec(ctx)
+	return raw, err
 }
 
+// RemoveFromProcessing acks an item: drops it from processing and releases its lease.
 func (s *RedisQueueStore) RemoveFromProcessing(ctx context.Context, campaignID, payload string) error {
-	return s.rdb.LRem(ctx, s.processingKey(campaignID), 1, payload).Err()
+	pipe := s.rdb.TxPipeline()
+	pipe.LRem(ctx, s.processingKey(campaignID), 1, payload)
+	pipe.ZRem(ctx, s.leaseKey(campaignID), payload)
+	pipe.HDel(ctx, s.leaseOwnerKey(campaignID), payload)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// extendLeaseScript pushes the deadline out only if the caller still owns the lease.
+var extendLeaseScript = redis.NewScript(`
+local owner = redis.call('HGET', KEYS[2], ARGV[1])
+if not owner or string.sub(owner, 1, #ARGV[2] + 1) ~= ARGV[2] .. '|' then
+  return 0
+end
+if not redis.call('ZSCORE', KEYS[1], ARGV[1]) then
+  return 0
+end
+redis.call('ZADD', KEYS[1], ARGV[3], ARGV[1])
+return 1
+`)
+
+// ExtendLease returns false if the lease was lost (expired and requeued).
+func (s *RedisQueueStore) ExtendLease(ctx context.Context, campaignID, payload, workerID string, lease time.Duration) (bool, error) {
+	deadline := time.Now().Add(lease).UnixMilli()
+	n, err := extendLeaseScript.Run(ctx, s.rdb, []string{s.leaseKey(campaignID), s.leaseOwnerKey(campaignID)},
+		payload, workerID, deadline).Int()
+	return n == 1, err
 }
 
 func (s *RedisQueueStore) InitProgress(ctx context.Context, campaignID string, total int64) error {
@@ -43,7 +162,7 @@ func (s *RedisQueueStore) InitProgress(ctx context.Context, campaignID string, t
 
 	pipe := s.rdb.TxPipeline()
 	pipe.HSet(ctx, key, "total", total)
-	pipe.HSetNX(ctx, key, "sent", 0)   
+	pipe.HSetNX(ctx, key, "sent", 0)
 	pipe.HSetNX(ctx, key, "failed", 0)
 	_, err := pipe.Exec(ctx)
 	return err
@@ -57,12 +176,44 @@ func (s *RedisQueueStore) GetProgress(ctx context.Context, campaignID string) (m
 	return s.rdb.HGetAll(ctx, s.progressKey(campaignID)).Result()
 }
 
+func (s *RedisQueueStore) DeleteProgress(ctx context.Context, campaignID, field string) error {
+	return s.rdb.HDel(ctx, s.progressKey(campaignID), field).Err()
+}
+
 func (s *RedisQueueStore) SetStatus(ctx context.Context, campaignID, status string) error {
 	return s.rdb.Set(ctx, s.statusKey(campaignID), status, 0).Err()
 }
 
+// transitionScript sets the status only if the current value is one of the
+// allowed sources. Returns {1, old} on success, {0, current} otherwise.
+var transitionScript = redis.NewScript(`
+local cur = redis.call('GET', KEYS[1]) or ''
+for i = 2, #ARGV do
+  if ARGV[i] == cur then
+    redis.call('SET', KEYS[1], ARGV[1])
+    return {1, cur}
+  end
+end
+return {0, cur}
+`)
+
+func (s *RedisQueueStore) TransitionStatus(ctx context.Context, campaignID string, from []string, to string) (bool, string, error) {
+	args := make([]any, 0, len(from)+1)
+	args = append(args, to)
+	for _, f := range from {
+		args = append(args, f)
+	}
+	res, err := transitionScript.Run(ctx, s.rdb, []string{s.statusKey(campaignID)}, args...).Slice()
+	if err != nil {
+		return false, "", err
+	}
+	cur, _ := res[1].(string)
+	return res[0].(int64) == 1, cur, nil
+}
+
 func (s *RedisQueueStore) GetStatus(ctx context.Context, campaignID string) (string, error) {
-	return s.rdb.Get(ctx, s.statusKey(campaignID)).Result()
+	status, err := s.rdb.Get(ctx, s.statusKey(campaignID)).Result()
+	return status, notFound(err)
 }
 
 func (s *RedisQueueStore) SetRateLimit(ctx context.Context, campaignID string, limit int64) error {
@@ -70,23 +221,215 @@ func (s *RedisQueueStore) SetRateLimit(ctx context.Context, campaignID string, l
 }
 
 func (s *RedisQueueStore) GetRateLimit(ctx context.Context, campaignID string) (int64, error) {
-	return s.rdb.Get(ctx, s.rateLimitKey(campaignID)).Int64()
+	limit, err := s.rdb.Get(ctx, s.rateLimitKey(campaignID)).Int64()
+	return limit, notFound(err)
 }
 
-func (s *RedisQueueStore) IncrRateCount(ctx context.Context, campaignID string) (int64, error) {
-	key := s.rateCountKey(campaignID)
-	cnt, err := s.rdb.Incr(ctx, key).Result()
+func (s *RedisQueueStore) SetRateBurst(ctx context.Context, campaignID string, burst int64) error {
+	return s.rdb.Set(ctx, s.rateBurstKey(campaignID), burst, 0).Err()
+}
+
+func (s *RedisQueueStore) GetRateBurst(ctx context.Context, campaignID string) (int64, error) {
+	burst, err := s.rdb.Get(ctx, s.rateBurstKey(campaignID)).Int64()
+	return burst, notFound(err)
+}
+
+// Limits for scopes other than a single campaign (global, provider:<name>)
+// live in one hash: scope -> JSON RateLimit.
+func (s *RedisQueueStore) SetScopedLimit(ctx context.Context, scope string, limit RateLimit) error {
+	b, err := json.Marshal(limit)
+	if err != nil {
+		return err
+	}
+	return s.rdb.HSet(ctx, s.scopedLimitsKey(), scope, b).Err()
+}
+
+func (s *RedisQueueStore) DeleteScopedLimit(ctx context.Context, scope string) error {
+	pipe := s.rdb.TxPipeline()
+	pipe.HDel(ctx, s.scopedLimitsKey(), scope)
+	pipe.Del(ctx, s.rateTATKey(scope))
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+func (s *RedisQueueStore) GetScopedLimits(ctx context.Context) (map[string]RateLimit, error) {
+	all, err := s.rdb.HGetAll(ctx, s.scopedLimitsKey()).Result()
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[string]RateLimit, len(all))
+	for scope, raw := range all {
+		var l RateLimit
+		if err := json.Unmarshal([]byte(raw), &l); err != nil {
+			return nil, fmt.Errorf("limit %s: %w", scope, err)
+		}
+		out[scope] = l
+	}
+	return out, nil
+}
+
+// gcraScript admits one send only if every bucket has room (all or nothing).
+// KEYS are theoretical-arrival-time keys; ARGV holds (interval_ms, burst) per
+// key. Server time is used so replicas with skewed clocks agree. Returns
+// {1, 0, 0} when admitted, or {0, wait_ms, index} of the tightest bucket.
+// Each key expires once its TAT is in the past, so nothing outlives its use.
+var gcraScript = redis.NewScript(`
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+local tats = {}
+local wait, worst = 0, 0
+for i, key in ipairs(KEYS) do
+  local interval = tonumber(ARGV[2 * i - 1])
+  local burst = tonumber(ARGV[2 * i])
+  local tat = tonumber(redis.call('GET', key) or now)
+  if tat < now then tat = now end
+  local new_tat = tat + interval
+  local allow_at = new_tat - interval * burst
+  if allow_at > now and allow_at - now > wait then
+    wait, worst = allow_at - now, i
+  end
+  tats[i] = new_tat
+end
+if wait > 0 then
+  return {0, wait, worst}
+end
+for i, key in ipairs(KEYS) do
+  redis.call('SET', key, tats[i], 'PX', tats[i] - now)
+end
+return {1, 0, 0}
+`)
+
+// TakeRate consumes one slot from every bucket, or none. When refused it
+// returns how long to wait and the index of the bucket that refused.
+func (s *RedisQueueStore) TakeRate(ctx context.Context, buckets []rateBucket) (bool, time.Duration, int, error) {
+	keys := make([]string, 0, len(buckets))
+	args := make([]any, 0, 2*len(buckets))
+	for _, b := range buckets {
+		interval := b.Limit.interval().Milliseconds()
+		if interval < 1 {
+			interval = 1 // above 60k TPM the limiter is effectively off
+		}
+		keys = append(keys, s.rateTATKey(b.Scope))
+		args = append(args, interval, b.Limit.Burst)
+	}
+	res, err := gcraScript.Run(ctx, s.rdb, keys, args...).Int64Slice()
+	if err != nil {
+		return false, 0, 0, err
+	}
+	return res[0] == 1, time.Duration(res[1]) * time.Millisecond, int(res[2]) - 1, nil
+}
+
+// RateAvailable reports how many sends the bucket would admit right now.
+func (s *RedisQueueStore) RateAvailable(ctx context.Context, scope string, limit RateLimit) (int64, error) {
+	tat, err := s.rdb.Get(ctx, s.rateTATKey(scope)).Int64()
+	if err == redis.Nil {
+		return limit.Burst, nil
+	}
 	if err != nil {
 		return 0, err
 	}
-	if cnt == 1 {
-		_ = s.rdb.Expire(ctx, key, time.Minute).Err()
+	interval := limit.interval().Milliseconds()
+	if interval < 1 {
+		return limit.Burst, nil
+	}
+	backlog := tat - time.Now().UnixMilli()
+	if backlog <= 0 {
+		return limit.Burst, nil
 	}
-	return cnt, nil
+	avail := limit.Burst - (backlog+interval-1)/interval
+	if avail < 0 {
+		avail = 0
+	}
+	return avail, nil
+}
+
+// rateCountScript increments the counter and starts its window in one step,
+// so a key can never be left without a TTL.
+var rateCountScript = redis.NewScript(`
+local n = redis.call('INCR', KEYS[1])
+if n == 1 or redis.call('PTTL', KEYS[1]) < 0 then
+  redis.call('PEXPIRE', KEYS[1], ARGV[1])
+end
+return n
+`)
+
+// IncrRateCount counts one admitted send in a fixed one-minute window. It only
+// feeds tpm_used in the status response; the limiter itself is GCRA.
+func (s *RedisQueueStore) IncrRateCount(ctx context.Context, campaignID string) (int64, error) {
+	return rateCountScript.Run(ctx, s.rdb, []string{s.rateCountKey(campaignID)}, time.Minute.Milliseconds()).Int64()
 }
 
 func (s *RedisQueueStore) GetRateCount(ctx context.Context, campaignID string) (int64, error) {
-	return s.rdb.Get(ctx, s.rateCountKey(campaignID)).Int64()
+	n, err := s.rdb.Get(ctx, s.rateCountKey(campaignID)).Int64()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	return n, err
+}
+
+// Campaign message (sender, subject, bodies, headers...) stored as JSON.
+func (s *RedisQueueStore) SetMessage(ctx context.Context, campaignID string, msg *Message) error {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return s.rdb.Set(ctx, s.messageKey(campaignID), b, 0).Err()
+}
+
+// GetMessage returns nil (and no error) when the campaign has no stored message.
+func (s *RedisQueueStore) GetMessage(ctx context.Context, campaignID string) (*Message, error) {
+	b, err := s.rdb.Get(ctx, s.messageKey(campaignID)).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var msg Message
+	if err := json.Unmarshal(b, &msg); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+// Campaign template stored as JSON. GetTemplate returns the raw JSON so callers
+// can cache compiled templates by content; "" means no template.
+func (s *RedisQueueStore) SetTemplate(ctx context.Context, campaignID string, t *Template) error {
+	b, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	return s.rdb.Set(ctx, s.templateKey(campaignID), b, 0).Err()
+}
+
+func (s *RedisQueueStore) GetTemplate(ctx context.Context, campaignID string) (string, error) {
+	raw, err := s.rdb.Get(ctx, s.templateKey(campaignID)).Result()
+	if err == redis.Nil {
+		return "", nil
+	}
+	return raw, err
+}
+
+// CSV columns seen at ingestion ("email" first), stored as JSON.
+func (s *RedisQueueStore) SetColumns(ctx context.Context, campaignID string, columns []string) error {
+	b, err := json.Marshal(columns)
+	if err != nil {
+		return err
+	}
+	return s.rdb.Set(ctx, s.columnsKey(campaignID), b, 0).Err()
+}
+
+// GetColumns returns nil when the upload had no header row.
+func (s *RedisQueueStore) GetColumns(ctx context.Context, campaignID string) ([]string, error) {
+	b, err := s.rdb.Get(ctx, s.columnsKey(campaignID)).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var cols []string
+	return cols, json.Unmarshal(b, &cols)
 }
 
 // Retry ZSET helpers
@@ -94,31 +437,398 @@ func (s *RedisQueueStore) AddRetry(ctx context.Context, campaignID string, unixT
 	return s.rdb.ZAdd(ctx, s.retryKey(campaignID), redis.Z{Score: float64(unixTs), Member: payload}).Err()
 }
 
-func (s *RedisQueueStore) PopDueRetries(ctx context.Context, campaignID string, now int64) ([]string, error) {
-	items, err := s.rdb.ZRangeByScore(ctx, s.retryKey(campaignID), &redis.ZRangeBy{Min: "-inf", Max: fmt.Sprintf("%d", now)}).Result()
-	if err != nil {
-		return nil, err
+// promoteRetriesScript moves up to ARGV[2] members scored <= ARGV[1] from the
+// retry ZSET into the queue in one atomic step, so concurrent reconcilers can
+// neither duplicate nor drop a retry.
+var promoteRetriesScript = redis.NewScript(`
+local items = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, tonumber(ARGV[2]))
+for _, item in ipairs(items) do
+  redis.call('ZREM', KEYS[1], item)
+  redis.call('LPUSH', KEYS[2], item)
+end
+return #items
+`)
+
+// AddRetryBatch schedules many jobs with a single variadic ZADD.
+func (s *RedisQueueStore) AddRetryBatch(ctx context.Context, campaignID string, items []retryItem) error {
+	if len(items) == 0 {
+		return nil
 	}
-	if len(items) > 0 {
-		_ = s.rdb.ZRemRangeByScore(ctx, s.retryKey(campaignID), "-inf", fmt.Sprintf("%d", now)).Err()
+	zs := make([]redis.Z, 0, len(items))
+	for _, it := range items {
+		zs = append(zs, redis.Z{Score: float64(it.At), Member: it.Payload})
 	}
-	return items, nil
+	return s.rdb.ZAdd(ctx, s.retryKey(campaignID), zs...).Err()
+}
+
+// PromoteDueRetries returns how many retries were moved (at most max).
+func (s *RedisQueueStore) PromoteDueRetries(ctx context.Context, campaignID string, now int64, max int) (int, error) {
+	return promoteRetriesScript.Run(ctx, s.rdb, []string{s.retryKey(campaignID), s.queueKey(campaignID)}, now, max).Int()
+}
+
+// Dead letters: hash jobID -> payload, plus a ZSET of jobIDs scored by the
+// failure time (unix ms) for paging in order.
+func (s *RedisQueueStore) AddDeadLetter(ctx context.Context, campaignID, jobID, payload string, at time.Time) error {
+	pipe := s.rdb.TxPipeline()
+	pipe.HSet(ctx, s.deadKey(campaignID), jobID, payload)
+	pipe.ZAdd(ctx, s.deadIndexKey(campaignID), redis.Z{Score: float64(at.UnixMilli()), Member: jobID})
+	_, err := pipe.Exec(ctx)
+	return err
 }
 
-// Move everything from processing back to queue (used by reconciler)
-func (s *RedisQueueStore) RequeueProcessingAll(ctx context.Context, campaignID string, max int) error {
-	for i := 0; i < max; i++ {
-		item, err := s.rdb.RPopLPush(ctx, s.processingKey(campaignID), s.queueKey(campaignID)).Result()
-		if err == redis.Nil {
-			return nil
+// DeadLetters returns one page of payloads, oldest first, and the total count.
+func (s *RedisQueueStore) DeadLetters(ctx context.Context, campaignID string, offset, limit int) ([]string, int64, error) {
+	total, err := s.rdb.ZCard(ctx, s.deadIndexKey(campaignID)).Result()
+	if err != nil || limit <= 0 {
+		return nil, total, err
+	}
+	ids, err := s.rdb.ZRange(ctx, s.deadIndexKey(campaignID), int64(offset), int64(offset+limit-1)).Result()
+	if err != nil || len(ids) == 0 {
+		return nil, total, err
+	}
+	vals, err := s.rdb.HMGet(ctx, s.deadKey(campaignID), ids...).Result()
+	if err != nil {
+		return nil, total, err
+	}
+	out := make([]string, 0, len(vals))
+	for _, v := range vals {
+		if raw, ok := v.(string); ok {
+			out = append(out, raw)
 		}
+	}
+	return out, total, nil
+}
+
+// Deliveries: hash email -> JSON Delivery; a later delivery to the same
+// address replaces the earlier one.
+func (s *RedisQueueStore) RecordDeliveries(ctx context.Context, campaignID string, ds []Delivery) error {
+	if len(ds) == 0 {
+		return nil
+	}
+	vals := make([]any, 0, 2*len(ds))
+	for _, d := range ds {
+		b, err := json.Marshal(d)
 		if err != nil {
 			return err
 		}
-		_ = item
+		vals = append(vals, d.Email, string(b))
+	}
+	return s.rdb.HSet(ctx, s.deliveredKey(campaignID), vals...).Err()
+}
+
+func (s *RedisQueueStore) GetDelivery(ctx context.Context, campaignID, email string) (Delivery, error) {
+	var d Delivery
+	b, err := s.rdb.HGet(ctx, s.deliveredKey(campaignID), email).Bytes()
+	if err == redis.Nil {
+		return d, ErrNotFound
+	}
+	if err != nil {
+		return d, err
+	}
+	err = json.Unmarshal(b, &d)
+	return d, err
+}
+
+// takeDeadScript removes the listed job IDs (ARGV[2..]) or, when none are
+// listed, the ARGV[1] oldest, and returns their payloads.
+var takeDeadScript = redis.NewScript(`
+local ids = {}
+if #ARGV > 1 then
+  for i = 2, #ARGV do ids[#ids + 1] = ARGV[i] end
+else
+  ids = redis.call('ZRANGE', KEYS[2], 0, tonumber(ARGV[1]) - 1)
+end
+local out = {}
+for _, id in ipairs(ids) do
+  local p = redis.call('HGET', KEYS[1], id)
+  if p then
+    redis.call('HDEL', KEYS[1], id)
+    out[#out + 1] = p
+  end
+  redis.call('ZREM', KEYS[2], id)
+end
+return out
+`)
+
+// TakeDeadLetters removes and returns the given dead letters, or the max
+// oldest when jobIDs is empty. Unknown IDs are ignored.
+func (s *RedisQueueStore) TakeDeadLetters(ctx context.Context, campaignID string, jobIDs []string, max int) ([]string, error) {
+	args := make([]any, 0, len(jobIDs)+1)
+	args = append(args, max)
+	for _, id := range jobIDs {
+		args = append(args, id)
+	}
+	return takeDeadScript.Run(ctx, s.rdb, []string{s.deadKey(campaignID), s.deadIndexKey(campaignID)}, args...).StringSlice()
+}
+
+// Retries returns one page of the retry ZSET, soonest first, and its size.
+func (s *RedisQueueStore) Retries(ctx context.Context, campaignID string, offset, limit int) ([]retryItem, int64, error) {
+	total, err := s.rdb.ZCard(ctx, s.retryKey(campaignID)).Result()
+	if err != nil || limit <= 0 {
+		return nil, total, err
+	}
+	zs, err := s.rdb.ZRangeWithScores(ctx, s.retryKey(campaignID), int64(offset), int64(offset+limit-1)).Result()
+	if err != nil {
+		return nil, total, err
+	}
+	out := make([]retryItem, 0, len(zs))
+	for _, z := range zs {
+		raw, _ := z.Member.(string)
+		out = append(out, retryItem{At: int64(z.Score), Payload: raw})
+	}
+	return out, total, nil
+}
+
+// requeueExpiredScript first adopts processing items that have no lease (the
+// worker died between BRPOPLPUSH and taking the lease) by giving them a fresh
+// deadline, then moves items whose lease expired back to the queue.
+var requeueExpiredScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local grace = tonumber(ARGV[2])
+local max = tonumber(ARGV[3])
+for _, item in ipairs(redis.call('LRANGE', KEYS[1], 0, max - 1)) do
+  if not redis.call('ZSCORE', KEYS[3], item) then
+    redis.call('ZADD', KEYS[3], now + grace, item)
+  end
+end
+local n = 0
+for _, item in ipairs(redis.call('ZRANGEBYSCORE', KEYS[3], '-inf', now, 'LIMIT', 0, max)) do
+  redis.call('ZREM', KEYS[3], item)
+  redis.call('HDEL', KEYS[4], item)
+  if redis.call('LREM', KEYS[1], 1, item) > 0 then
+    redis.call('LPUSH', KEYS[2], item)
+    n = n + 1
+  end
+end
+return n
+`)
+
+// RequeueExpired moves up to max items whose lease deadline has passed back to
+// the queue (used by reconciler). Items still leased are left alone.
+func (s *RedisQueueStore) RequeueExpired(ctx context.Context, campaignID string, lease time.Duration, max int) (int, error) {
+	keys := []string{s.processingKey(campaignID), s.queueKey(campaignID), s.leaseKey(campaignID), s.leaseOwnerKey(campaignID)}
+	return requeueExpiredScript.Run(ctx, s.rdb, keys, time.Now().UnixMilli(), lease.Milliseconds(), max).Int()
+}
+
+// drainScript atomically removes up to ARGV[1] pending items, taking from the
+// queue first, then processing (releasing leases), then the retry ZSET. With
+// KEYS[6] the items are also pushed onto that held list, and ARGV[2] (its
+// token) is added to the KEYS[7] set.
+var drainScript = redis.NewScript(`
+local max = tonumber(ARGV[1])
+local out = {}
+for _, key in ipairs({KEYS[1], KEYS[2]}) do
+  local want = max - #out
+  if want <= 0 then break end
+  local items = redis.call('LRANGE', key, 0, want - 1)
+  if #items > 0 then
+    redis.call('LTRIM', key, #items, -1)
+    for _, item in ipairs(items) do
+      if key == KEYS[2] then
+        redis.call('ZREM', KEYS[4], item)
+        redis.call('HDEL', KEYS[5], item)
+      end
+      out[#out + 1] = item
+    end
+  end
+end
+local want = max - #out
+if want > 0 then
+  local items = redis.call('ZRANGE', KEYS[3], 0, want - 1)
+  if #items > 0 then
+    redis.call('ZREMRANGEBYRANK', KEYS[3], 0, #items - 1)
+    for _, item in ipairs(items) do out[#out + 1] = item end
+  end
+end
+if KEYS[6] and #out > 0 then
+  redis.call('RPUSH', KEYS[6], unpack(out))
+  redis.call('SADD', KEYS[7], ARGV[2])
+end
+return out
+`)
+
+// DrainPending removes and returns up to max jobs that have not been sent.
+func (s *RedisQueueStore) DrainPending(ctx context.Context, campaignID string, max int) ([]string, error) {
+	keys := []string{s.queueKey(campaignID), s.processingKey(campaignID), s.retryKey(campaignID), s.leaseKey(campaignID), s.leaseOwnerKey(campaignID)}
+	return drainScript.Run(ctx, s.rdb, keys, max).StringSlice()
+}
+
+// HoldPending drains like DrainPending but also parks the items on the
+// token's held list, so they can be put back if whatever consumes them fails.
+func (s *RedisQueueStore) HoldPending(ctx context.Context, campaignID, token string, max int) ([]string, error) {
+	keys := []string{s.queueKey(campaignID), s.processingKey(campaignID), s.retryKey(campaignID), s.leaseKey(campaignID), s.leaseOwnerKey(campaignID),
+		s.heldKey(campaignID, token), s.heldTokensKey(campaignID)}
+	return drainScript.Run(ctx, s.rdb, keys, max, token).StringSlice()
+}
+
+// releaseScript moves up to ARGV[1] held items back onto the queue.
+var releaseScript = redis.NewScript(`
+local items = redis.call('LRANGE', KEYS[1], 0, tonumber(ARGV[1]) - 1)
+if #items == 0 then return 0 end
+redis.call('LTRIM', KEYS[1], #items, -1)
+redis.call('RPUSH', KEYS[2], unpack(items))
+return #items
+`)
+
+// ReleaseHeld empties the token's held list, either back onto the queue or
+// for good, and forgets the token.
+func (s *RedisQueueStore) ReleaseHeld(ctx context.Context, campaignID, token string, requeue bool) (int, error) {
+	held := s.heldKey(campaignID, token)
+	total := 0
+	if requeue {
+		for {
+			n, err := releaseScript.Run(ctx, s.rdb, []string{held, s.queueKey(campaignID)}, drainBatch).Int()
+			total += n
+			if err != nil {
+				return total, err
+			}
+			if n < drainBatch {
+				break
+			}
+		}
+	} else {
+		n, err := s.rdb.LLen(ctx, held).Result()
+		if err != nil {
+			return 0, err
+		}
+		if err := s.rdb.Unlink(ctx, held).Err(); err != nil {
+			return 0, err
+		}
+		total = int(n)
+	}
+	return total, s.rdb.SRem(ctx, s.heldTokensKey(campaignID), token).Err()
+}
+
+func (s *RedisQueueStore) HeldTokens(ctx context.Context, campaignID string) ([]string, error) {
+	return s.rdb.SMembers(ctx, s.heldTokensKey(campaignID)).Result()
+}
+
+// completeScript flips a running campaign to completed once nothing is left
+// anywhere (queue, processing, retry ZSET) and the counters account for every
+// recipient. Returns 1 if this call completed the campaign.
+var completeScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) ~= 'running' then return 0 end
+if redis.call('LLEN', KEYS[2]) > 0 or redis.call('LLEN', KEYS[3]) > 0 or redis.call('ZCARD', KEYS[4]) > 0 then
+  return 0
+end
+local total = tonumber(redis.call('HGET', KEYS[5], 'total'))
+if not total then return 0 end
+local done = 0
+for _, f in ipairs({'sent', 'failed', 'cancelled'}) do
+  done = done + (tonumber(redis.call('HGET', KEYS[5], f)) or 0)
+end
+if done < total then return 0 end
+redis.call('SET', KEYS[1], 'completed')
+redis.call('HSET', KEYS[5], 'finished_at', ARGV[1])
+return 1
+`)
+
+func (s *RedisQueueStore) CompleteIfDone(ctx context.Context, campaignID string, finishedAt time.Time) (bool, error) {
+	keys := []string{s.statusKey(campaignID), s.queueKey(campaignID), s.processingKey(campaignID), s.retryKey(campaignID), s.progressKey(campaignID)}
+	n, err := completeScript.Run(ctx, s.rdb, keys, finishedAt.Format(time.RFC3339)).Int()
+	return n == 1, err
+}
+
+func (s *RedisQueueStore) PublishEvent(ctx context.Context, ev CampaignEvent) error {
+	b, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	return s.rdb.Publish(ctx, s.eventsChannel(), b).Err()
+}
+
+// Schedules: one ZSET per kind (start/stop), member campaign ID, score unix seconds.
+func (s *RedisQueueStore) SetSchedule(ctx context.Context, campaignID string, start, stop *time.Time) error {
+	pipe := s.rdb.TxPipeline()
+	for kind, at := range map[string]*time.Time{scheduleStart: start, scheduleStop: stop} {
+		if at == nil {
+			pipe.ZRem(ctx, s.scheduleKey(kind), campaignID)
+		} else {
+			pipe.ZAdd(ctx, s.scheduleKey(kind), redis.Z{Score: float64(at.Unix()), Member: campaignID})
+		}
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+func (s *RedisQueueStore) DueSchedules(ctx context.Context, kind string, now time.Time) ([]string, error) {
+	return s.rdb.ZRangeByScore(ctx, s.scheduleKey(kind), &redis.ZRangeBy{Min: "-inf", Max: fmt.Sprintf("%d", now.Unix())}).Result()
+}
+
+func (s *RedisQueueStore) ClearSchedule(ctx context.Context, kind, campaignID string) error {
+	return s.rdb.ZRem(ctx, s.scheduleKey(kind), campaignID).Err()
+}
+
+// Campaign definitions (JSON). CreateCampaignDef returns false if the ID is taken.
+func (s *RedisQueueStore) CreateCampaignDef(ctx context.Context, def *CampaignDef) (bool, error) {
+	b, err := json.Marshal(def)
+	if err != nil {
+		return false, err
+	}
+	return s.rdb.SetNX(ctx, s.defKey(def.ID), b, 0).Result()
+}
+
+func (s *RedisQueueStore) SaveCampaignDef(ctx context.Context, def *CampaignDef) error {
+	b, err := json.Marshal(def)
+	if err != nil {
+		return err
+	}
+	return s.rdb.Set(ctx, s.defKey(def.ID), b, 0).Err()
+}
+
+// GetCampaignDef returns nil (and no error) for unknown campaigns.
+func (s *RedisQueueStore) GetCampaignDef(ctx context.Context, campaignID string) (*CampaignDef, error) {
+	b, err := s.rdb.Get(ctx, s.defKey(campaignID)).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var def CampaignDef
+	if err := json.Unmarshal(b, &def); err != nil {
+		return nil, err
 	}
-	return nil
+	return &def, nil
 }
 
-func (s *RedisQueueStore) RegisterCampaign(ctx context.Context, campaignID string) { _ = s.rdb.SAdd(ctx, s.campaignsSet(), campaignID).Err() }
-func (s *RedisQueueStore) ListCampaigns(ctx context.Context) ([]string, error)     { return s.rdb.SMembers(ctx, s.campaignsSet()).Result() }
+// DeleteCampaign drops every key belonging to the campaign.
+func (s *RedisQueueStore) DeleteCampaign(ctx context.Context, campaignID string) error {
+	tokens, err := s.HeldTokens(ctx, campaignID)
+	if err != nil {
+		return err
+	}
+	pipe := s.rdb.TxPipeline()
+	for _, token := range tokens {
+		pipe.Del(ctx, s.heldKey(campaignID, token))
+	}
+	pipe.Del(ctx,
+		s.queueKey(campaignID), s.processingKey(campaignID), s.progressKey(campaignID),
+		s.statusKey(campaignID), s.rateLimitKey(campaignID), s.rateBurstKey(campaignID),
+		s.rateTATKey(campaignScope(campaignID)), s.rateCountKey(campaignID),
+		s.messageKey(campaignID), s.templateKey(campaignID), s.retryKey(campaignID),
+		s.defKey(campaignID), s.leaseKey(campaignID), s.leaseOwnerKey(campaignID),
+		s.columnsKey(campaignID), s.deadKey(campaignID), s.deadIndexKey(campaignID),
+		s.heldTokensKey(campaignID), s.deliveredKey(campaignID),
+	)
+	pipe.SRem(ctx, s.campaignsSet(), campaignID)
+	pipe.ZRem(ctx, s.scheduleKey(scheduleStart), campaignID)
+	pipe.ZRem(ctx, s.scheduleKey(scheduleStop), campaignID)
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+func (s *RedisQueueStore) RegisterCampaign(ctx context.Context, campaignID string) {
+	_ = s.rdb.SAdd(ctx, s.campaignsSet(), campaignID).Err()
+}
+func (s *RedisQueueStore) ListCampaigns(ctx context.Context) ([]string, error) {
+	return s.rdb.SMembers(ctx, s.campaignsSet()).Result()
+}
+
+// notFound maps redis.Nil onto the store-neutral ErrNotFound.
+func notFound(err error) error {
+	if errors.Is(err, redis.Nil) {
+		return ErrNotFound
+	}
+	return err
+}
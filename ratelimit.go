@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// RateLimit is a GCRA limit: TPM sends per minute on average, with up to
+// Burst sends allowed back to back after an idle period.
+type RateLimit struct {
+	TPM   int64 `json:"tpm"`
+	Burst int64 `json:"burst,omitempty"`
+}
+
+const (
+	defaultTPM   = 120 // safe fallback when a campaign has no limit
+	defaultBurst = 1   // smooth: one send every 60s/TPM
+)
+
+// interval is the GCRA emission interval (time between two sends at steady rate).
+func (l RateLimit) interval() time.Duration {
+	return time.Minute / time.Duration(l.TPM)
+}
+
+func (l RateLimit) withDefaults() RateLimit {
+	if l.TPM <= 0 {
+		l.TPM = defaultTPM
+	}
+	if l.Burst <= 0 {
+		l.Burst = defaultBurst
+	}
+	return l
+}
+
+// rateBucket names one limiter (e.g. "campaign:c1") together with its limit.
+type rateBucket struct {
+	Scope string
+	Limit RateLimit
+}
+
+// Limiter scopes, from widest to narrowest. Every send must fit all of them,
+// so the tightest configured limit wins.
+const globalScope = "global"
+
+func campaignScope(campaignID string) string { return "campaign:" + campaignID }
+func providerScope(name string) string       { return "provider:" + name }
+func domainScope(domain string) string       { return "domain:" + strings.ToLower(domain) }
+
+// recipientDomain returns the part after the last "@", or "".
+func recipientDomain(email string) string {
+	i := strings.LastIndexByte(email, '@')
+	if i < 0 {
+		return ""
+	}
+	return strings.ToLower(strings.TrimSpace(email[i+1:]))
+}
+
+// domainThrottled is returned by waitForRate when the recipient's domain is
+// the limit that refused. The job should be deferred rather than waited on,
+// so workers stay free for other domains.
+type domainThrottled struct {
+	domain string
+	wait   time.Duration
+}
+
+func (e *domainThrottled) Error() string {
+	return fmt.Sprintf("domain %s throttled for %s", e.domain, e.wait)
+}
+
+// campaignRateLimit returns the configured limit, or the defaults.
+func (c *Controller) campaignRateLimit(ctx context.Context, campaignID string) RateLimit {
+	var l RateLimit
+	l.TPM, _ = c.store.GetRateLimit(ctx, campaignID)
+	l.Burst, _ = c.store.GetRateBurst(ctx, campaignID)
+	return l.withDefaults()
+}
+
+// rateBuckets lists every limiter a send for this campaign must pass: global
+// and provider-account limits when configured, the campaign's own, and the
+// recipient domain's limit when email is set and its domain is configured.
+func (c *Controller) rateBuckets(ctx context.Context, campaignID, email string) ([]rateBucket, error) {
+	scoped, err := c.store.GetScopedLimits(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var buckets []rateBucket
+	for _, scope := range []string{globalScope, providerScope(c.providerName(ctx, campaignID))} {
+		if l, ok := scoped[scope]; ok && l.TPM > 0 {
+			buckets = append(buckets, rateBucket{Scope: scope, Limit: l.withDefaults()})
+		}
+	}
+	buckets = append(buckets, rateBucket{Scope: campaignScope(campaignID), Limit: c.campaignRateLimit(ctx, campaignID)})
+	if d := recipientDomain(email); d != "" {
+		if l, ok := scoped[domainScope(d)]; ok && l.TPM > 0 {
+			buckets = append(buckets, rateBucket{Scope: domainScope(d), Limit: l.withDefaults()})
+		}
+	}
+	return buckets, nil
+}
+
+// takeProviderRate spends one send from the provider-account limit, when one
+// is configured. FailoverProvider calls it for the route it is about to use,
+// since rateBuckets only knows the campaign's provider ("failover").
+func (c *Controller) takeProviderRate(ctx context.Context, provider string) (bool, time.Duration, error) {
+	scoped, err := c.store.GetScopedLimits(ctx)
+	if err != nil {
+		return false, 0, err
+	}
+	l, ok := scoped[providerScope(provider)]
+	if !ok || l.TPM <= 0 {
+		return true, 0, nil
+	}
+	ok, wait, _, err := c.store.TakeRate(ctx, []rateBucket{{Scope: providerScope(provider), Limit: l.withDefaults()}})
+	return ok, wait, err
+}
+
+// waitForRate blocks until every limiter admits one send to email. The limiter
+// reports exactly how long until the next slot, so we sleep that long rather
+// than polling. If the recipient domain is what refused, it returns
+// *domainThrottled instead of sleeping.
+func (c *Controller) waitForRate(ctx context.Context, campaignID, email string) error {
+	for {
+		buckets, err := c.rateBuckets(ctx, campaignID, email)
+		if err != nil {
+			return err
+		}
+		ok, wait, idx, err := c.store.TakeRate(ctx, buckets)
+		if err != nil {
+			return err
+		}
+		if ok {
+			_, _ = c.store.IncrRateCount(ctx, campaignID)
+			return nil
+		}
+		if scope := buckets[idx].Scope; strings.HasPrefix(scope, "domain:") {
+			return &domainThrottled{domain: strings.TrimPrefix(scope, "domain:"), wait: wait}
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// RateLimitStatus is one limiter level as shown in the status response.
+type RateLimitStatus struct {
+	Scope     string `json:"scope"`
+	TPM       int64  `json:"tpm"`
+	Burst     int64  `json:"burst"`
+	Available int64  `json:"available"`
+}
+
+func (c *Controller) rateLimitStatus(ctx context.Context, campaignID string) ([]RateLimitStatus, error) {
+	buckets, err := c.rateBuckets(ctx, campaignID, "")
+	if err != nil {
+		return nil, err
+	}
+	out := make([]RateLimitStatus, 0, len(buckets))
+	for _, b := range buckets {
+		avail, err := c.store.RateAvailable(ctx, b.Scope, b.Limit)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, RateLimitStatus{Scope: b.Scope, TPM: b.Limit.TPM, Burst: b.Limit.Burst, Available: avail})
+	}
+	return out, nil
+}
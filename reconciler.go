@@ -2,37 +2,64 @@ package main
 
 import (
 	"context"
-	"fmt"
+	"log"
 	"time"
 )
 
+// retryBatch caps how many retries one script call moves, so a large backlog
+// never blocks Redis for long.
+const retryBatch = 500
+
 // Periodically:
-// 1) Requeue any items lingering in the processing list (simple heal).
+// 0) Start / hard-stop scheduled campaigns that are due.
+// 1) Requeue processing items whose lease expired (worker died or hung).
 // 2) Move due retries back to the main queue.
+// 3) Mark campaigns with nothing left to send as completed.
 func StartReconciler(c *Controller, every time.Duration) {
 	t := time.NewTicker(every)
 	for range t.C {
 		ctx := context.Background()
+		c.runSchedules(ctx, time.Now())
+
 		campaigns, _ := c.store.ListCampaigns(ctx)
 		for _, id := range campaigns {
-			// 1) Requeue stuck processing (bounded loop for safety)
-			if err := c.store.RequeueProcessingAll(ctx, id, 1000); err != nil {
-				fmt.Println("requeue processing:", err)
+			// 1) Requeue expired leases (bounded for safety)
+			if n, err := c.store.RequeueExpired(ctx, id, c.visibility, 1000); err != nil {
+				log.Printf("requeue expired for %s: %v", id, err)
+			} else if n > 0 {
+				log.Printf("requeued %d expired jobs for %s", n, id)
 			}
 
-			// 2) Move due retries
+			// 2) Move due retries, one capped batch per script call
 			now := time.Now().Unix()
-			items, err := c.store.PopDueRetries(ctx, id, now)
-			if err != nil {
-				fmt.Println("retries pop:", err); continue
+			for {
+				n, err := c.store.PromoteDueRetries(ctx, id, now, retryBatch)
+				if err != nil {
+					log.Printf("promote retries for %s: %v", id, err)
+					break
+				}
+				if n < retryBatch {
+					break
+				}
 			}
-			for _, raw := range items {
-				_ = c.store.Enqueue(ctx, id, jsonRaw(raw))
+
+			// 3) Completion
+			if _, err := c.checkCompletion(ctx, id); err != nil {
+				log.Printf("completion check for %s: %v", id, err)
 			}
 		}
 	}
 }
 
-// small wrapper to enqueue already-serialized JSON payloads
-type jsonRaw string
-func (j jsonRaw) MarshalJSON() ([]byte, error) { return []byte(j), nil }
+// checkCompletion completes the campaign if it is done, stops its workers in
+// this process and fires the completion event. Workers in other processes
+// see the terminal status and exit on their next loop.
+func (c *Controller) checkCompletion(ctx context.Context, campaignID string) (bool, error) {
+	done, err := c.store.CompleteIfDone(ctx, campaignID, time.Now().UTC())
+	if err != nil || !done {
+		return false, err
+	}
+	go c.StopCampaign(campaignID)
+	c.emit(ctx, EventCompleted, campaignID)
+	return true, nil
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"net"
+	"time"
+)
+
+// RetryPolicy decides whether and when a failed send is tried again. Zero
+// fields take the defaults, which match the original behaviour: 4 attempts in
+// total, 2s/4s/8s apart.
+type RetryPolicy struct {
+	MaxAttempts int      `json:"max_attempts,omitempty"` // total sends including the first; default 4
+	BaseDelay   string   `json:"base_delay,omitempty"`   // delay before the first retry, e.g. "2s"
+	MaxDelay    string   `json:"max_delay,omitempty"`    // cap on any one delay; default "1h"
+	Multiplier  float64  `json:"multiplier,omitempty"`   // growth per retry; default 2
+	Jitter      float64  `json:"jitter,omitempty"`       // 0..1: randomise each delay by ±this fraction
+	RetryOn     []string `json:"retry_on,omitempty"`     // error classes to retry; empty = all retryable
+
+	// MaxThrottleWait bounds how long throttling may defer a job for free,
+	// counted from its first throttled send; default "24h". After that each
+	// throttled send spends an attempt like any other retryable failure.
+	MaxThrottleWait string `json:"max_throttle_wait,omitempty"`
+}
+
+// Error classes a send failure falls into. Permanent failures are
+// dead-lettered at once and auth failures pause the campaign; the rest are
+// retryable.
+const (
+	ErrClassTimeout   = "timeout"   // deadline exceeded / network timeout
+	ErrClassNetwork   = "network"   // connection refused, reset, DNS...
+	ErrClassTransient = "transient" // the provider failed the request (5xx)
+	ErrClassThrottled = "throttled" // provider rate limit (429); retried after Retry-After
+	ErrClassPermanent = "permanent" // rejected / hard bounce: never succeeds
+	ErrClassAuth      = "auth"      // bad or revoked credentials
+)
+
+var retryableClasses = map[string]bool{
+	ErrClassTimeout: true, ErrClassNetwork: true, ErrClassTransient: true, ErrClassThrottled: true,
+}
+
+const (
+	defaultMaxAttempts = 4
+	defaultBaseDelay   = 2 * time.Second
+	defaultMaxDelay    = time.Hour
+	defaultMultiplier  = 2
+
+	defaultMaxThrottleWait = 24 * time.Hour
+)
+
+// errorClass sorts a send error into one of the ErrClass* values. Providers
+// say what went wrong with a *ProviderError; anything else is guessed.
+func errorClass(err error) string {
+	var perr *ProviderError
+	var nerr net.Error
+	switch {
+	case errors.As(err, &perr):
+		return perr.Class
+	case errors.Is(err, context.DeadlineExceeded):
+		return ErrClassTimeout
+	case errors.As(err, &nerr):
+		if nerr.Timeout() {
+			return ErrClassTimeout
+		}
+		return ErrClassNetwork
+	default:
+		return ErrClassTransient
+	}
+}
+
+// compiledPolicy is a RetryPolicy with defaults applied and delays parsed.
+type compiledPolicy struct {
+	maxAttempts int
+	base, max   time.Duration
+	multiplier  float64
+	jitter      float64
+	retryOn     map[string]bool // nil = every retryable class
+
+	maxThrottleWait time.Duration
+}
+
+func (p *RetryPolicy) Validate() error {
+	if p == nil {
+		return nil
+	}
+	_, err := p.compile()
+	return err
+}
+
+func (p *RetryPolicy) isZero() bool {
+	return p.MaxAttempts == 0 && p.BaseDelay == "" && p.MaxDelay == "" &&
+		p.Multiplier == 0 && p.Jitter == 0 && len(p.RetryOn) == 0 && p.MaxThrottleWait == ""
+}
+
+func (p *RetryPolicy) compile() (*compiledPolicy, error) {
+	cp := &compiledPolicy{maxAttempts: defaultMaxAttempts, base: defaultBaseDelay, max: defaultMaxDelay, multiplier: defaultMultiplier,
+		maxThrottleWait: defaultMaxThrottleWait}
+	if p == nil {
+		return cp, nil
+	}
+	if p.MaxAttempts < 0 {
+		return nil, fmt.Errorf("%w: max_attempts must be >= 1", ErrInvalidCampaign)
+	}
+	if p.MaxAttempts > 0 {
+		cp.maxAttempts = p.MaxAttempts
+	}
+	for _, d := range []struct {
+		name, val string
+		dst       *time.Duration
+	}{{"base_delay", p.BaseDelay, &cp.base}, {"max_delay", p.MaxDelay, &cp.max}, {"max_throttle_wait", p.MaxThrottleWait, &cp.maxThrottleWait}} {
+		if d.val == "" {
+			continue
+		}
+		v, err := time.ParseDuration(d.val)
+		if err != nil || v <= 0 {
+			return nil, fmt.Errorf("%w: %s %q (want a positive duration like 30s)", ErrInvalidCampaign, d.name, d.val)
+		}
+		*d.dst = v
+	}
+	if cp.max < cp.base {
+		return nil, fmt.Errorf("%w: max_delay is shorter than base_delay", ErrInvalidCampaign)
+	}
+	if p.Multiplier < 0 || (p.Multiplier > 0 && p.Multiplier < 1) {
+		return nil, fmt.Errorf("%w: multiplier must be >= 1", ErrInvalidCampaign)
+	}
+	if p.Multiplier > 0 {
+		cp.multiplier = p.Multiplier
+	}
+	if p.Jitter < 0 || p.Jitter > 1 {
+		return nil, fmt.Errorf("%w: jitter must be between 0 and 1", ErrInvalidCampaign)
+	}
+	cp.jitter = p.Jitter
+	for _, class := range p.RetryOn {
+		if !retryableClasses[class] {
+			return nil, fmt.Errorf("%w: retry_on: unknown error class %q", ErrInvalidCampaign, class)
+		}
+		if cp.retryOn == nil {
+			cp.retryOn = map[string]bool{}
+		}
+		cp.retryOn[class] = true
+	}
+	return cp, nil
+}
+
+// retries reports whether errors of class are retried at all.
+func (cp *compiledPolicy) retries(class string) bool {
+	return retryableClasses[class] && (cp.retryOn == nil || cp.retryOn[class])
+}
+
+// next returns when to retry after the given number of failed attempts with
+// an error of class, or false if the job should be dead-lettered.
+func (cp *compiledPolicy) next(attempts int, class string, now time.Time) (time.Time, bool) {
+	if attempts >= cp.maxAttempts || !cp.retries(class) {
+		return time.Time{}, false
+	}
+	delay := float64(cp.base) * math.Pow(cp.multiplier, float64(attempts-1))
+	if delay > float64(cp.max) {
+		delay = float64(cp.max)
+	}
+	if cp.jitter > 0 {
+		delay *= 1 + cp.jitter*(2*rand.Float64()-1)
+	}
+	return now.Add(time.Duration(delay)), true
+}
+
+// retryPolicy returns the campaign's policy, or the defaults.
+func (c *Controller) retryPolicy(ctx context.Context, campaignID string) *compiledPolicy {
+	def, _ := c.campaignDef(ctx, campaignID)
+	if def != nil && def.RetryPolicy != nil {
+		if cp, err := def.RetryPolicy.compile(); err == nil {
+			return cp
+		}
+	}
+	cp, _ := (*RetryPolicy)(nil).compile()
+	return cp
+}
+
+// RetryEntry is one recipient waiting in the retry set.
+type RetryEntry struct {
+	ID          string    `json:"id"`
+	Email       string    `json:"email"`
+	Attempts    int       `json:"attempts"` // failed attempts so far; 0 = deferred, not failed
+	NextRetryAt time.Time `json:"next_retry_at"`
+	LastError   string    `json:"last_error,omitempty"`
+}
+
+// RetryPage is one page of a campaign's retry set, soonest first.
+type RetryPage struct {
+	Total  int64        `json:"total"`
+	Offset int          `json:"offset"`
+	Items  []RetryEntry `json:"items"`
+}
+
+// Retries lists jobs waiting to be retried (or deferred until later).
+func (c *Controller) Retries(ctx context.Context, campaignID string, offset, limit int) (*RetryPage, error) {
+	if _, err := c.store.GetStatus(ctx, campaignID); isNotFound(err) {
+		return nil, ErrCampaignNotFound
+	}
+	items, total, err := c.store.Retries(ctx, campaignID, offset, limit)
+	if err != nil {
+		return nil, err
+	}
+	page := &RetryPage{Total: total, Offset: offset, Items: make([]RetryEntry, 0, len(items))}
+	for _, it := range items {
+		var job JobPayload
+		if json.Unmarshal([]byte(it.Payload), &job) != nil {
+			continue
+		}
+		page.Items = append(page.Items, RetryEntry{
+			ID: job.ID, Email: job.Email, Attempts: job.Attempts,
+			NextRetryAt: time.Unix(it.At, 0).UTC(), LastError: job.LastError,
+		})
+	}
+	return page, nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicyNext(t *testing.T) {
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		policy   *RetryPolicy
+		attempts int
+		class    string
+		want     time.Duration // 0 = dead-letter
+	}{
+		{"default first retry", nil, 1, ErrClassTransient, 2 * time.Second},
+		{"default second retry", nil, 2, ErrClassTimeout, 4 * time.Second},
+		{"default third retry", nil, 3, ErrClassNetwork, 8 * time.Second},
+		{"default gives up after 4", nil, 4, ErrClassTransient, 0},
+		{"permanent never retried", nil, 1, ErrClassPermanent, 0},
+		{"auth never retried", nil, 1, ErrClassAuth, 0},
+		{"custom growth", &RetryPolicy{MaxAttempts: 6, BaseDelay: "30s", Multiplier: 3}, 3, ErrClassTransient, 270 * time.Second},
+		{"capped by max_delay", &RetryPolicy{MaxAttempts: 10, BaseDelay: "10s", MaxDelay: "30s", Multiplier: 10}, 3, ErrClassTransient, 30 * time.Second},
+		{"retry_on allows", &RetryPolicy{RetryOn: []string{ErrClassTimeout}}, 1, ErrClassTimeout, 2 * time.Second},
+		{"retry_on excludes", &RetryPolicy{RetryOn: []string{ErrClassTimeout}}, 1, ErrClassTransient, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cp, err := tt.policy.compile()
+			if err != nil {
+				t.Fatal(err)
+			}
+			at, ok := cp.next(tt.attempts, tt.class, now)
+			if tt.want == 0 {
+				if ok {
+					t.Fatalf("retry at %s, want dead-letter", at)
+				}
+				return
+			}
+			if !ok || at.Sub(now) != tt.want {
+				t.Fatalf("next = %s (ok=%v), want +%s", at.Sub(now), ok, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryPolicyJitter(t *testing.T) {
+	cp, err := (&RetryPolicy{BaseDelay: "10s", Jitter: 0.2}).compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	for i := 0; i < 100; i++ {
+		at, _ := cp.next(1, ErrClassTransient, now)
+		if d := at.Sub(now); d < 8*time.Second || d > 12*time.Second {
+			t.Fatalf("delay %s outside 10s ±20%%", d)
+		}
+	}
+}
+
+func TestRetryPolicyValidate(t *testing.T) {
+	for _, p := range []RetryPolicy{
+		{MaxAttempts: -1},
+		{BaseDelay: "soon"},
+		{BaseDelay: "1m", MaxDelay: "10s"},
+		{Multiplier: 0.5},
+		{Jitter: 1.5},
+		{RetryOn: []string{ErrClassPermanent}},
+		{MaxThrottleWait: "0s"},
+	} {
+		if err := p.Validate(); !errors.Is(err, ErrInvalidCampaign) {
+			t.Errorf("%+v: err = %v, want ErrInvalidCampaign", p, err)
+		}
+	}
+}
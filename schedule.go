@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+const (
+	EventStarted = "campaign.started"
+
+	// schedule kinds (one ZSET each)
+	scheduleStart = "start"
+	scheduleStop  = "stop"
+)
+
+// Validate rejects a stop time that is not after the start time.
+func (s *Schedule) Validate() error {
+	if s == nil {
+		return nil
+	}
+	if s.StartAt != nil && s.StopAt != nil && !s.StopAt.After(*s.StartAt) {
+		return fmt.Errorf("%w: stop_at must be after start_at", ErrInvalidCampaign)
+	}
+	return nil
+}
+
+// scheduleCampaign persists the schedule on the definition and in the
+// store's schedule ZSETs, which the reconciler polls. A nil schedule (or nil
+// times) clears it.
+func (c *Controller) scheduleCampaign(ctx context.Context, campaignID string, sched *Schedule) error {
+	if err := sched.Validate(); err != nil {
+		return err
+	}
+	var start, stop *time.Time
+	if sched != nil {
+		start, stop = sched.StartAt, sched.StopAt
+	}
+	return c.store.SetSchedule(ctx, campaignID, start, stop)
+}
+
+// runSchedules starts campaigns whose start time has come and hard-stops
+// (cancels) those past their stop time. Schedules live in the store, so they
+// survive restarts; the status CAS makes it safe with several replicas.
+func (c *Controller) runSchedules(ctx context.Context, now time.Time) {
+	starts, err := c.store.DueSchedules(ctx, scheduleStart, now)
+	if err != nil {
+		log.Printf("due starts: %v", err)
+	}
+	for _, id := range starts {
+		status, _ := c.store.GetStatus(ctx, id)
+		switch status {
+		case "", StateDraft:
+			continue // not ready yet (no recipients); try again next tick
+		case StateReady:
+			if err := c.Transition(ctx, id, StateRunning); err != nil {
+				if !errors.Is(err, ErrIllegalTransition) {
+					log.Printf("scheduled start %s: %v", id, err)
+					continue
+				}
+				// another replica won the race
+			} else {
+				c.StartCampaign(id)
+				c.emit(ctx, EventStarted, id)
+			}
+		}
+		_ = c.store.ClearSchedule(ctx, scheduleStart, id)
+	}
+
+	stops, err := c.store.DueSchedules(ctx, scheduleStop, now)
+	if err != nil {
+		log.Printf("due stops: %v", err)
+	}
+	for _, id := range stops {
+		status, _ := c.store.GetStatus(ctx, id)
+		if !isTerminal(status) {
+			res, err := c.CancelCampaign(ctx, id, false)
+			if err != nil {
+				log.Printf("scheduled stop %s: %v", id, err)
+				continue
+			}
+			log.Printf("scheduled stop %s: %d recipients cancelled", id, res.Cancelled)
+		}
+		_ = c.store.ClearSchedule(ctx, scheduleStop, id)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// SendWindow restricts sending to certain hours on certain weekdays in one
+// timezone, e.g. 09:00–18:00 Mon–Fri Europe/Berlin. End <= Start means the
+// window runs past midnight into the next day.
+type SendWindow struct {
+	Timezone string   `json:"timezone"`       // IANA name; default UTC
+	Days     []string `json:"days,omitempty"` // "mon".."sun"; empty = every day
+	Start    string   `json:"start"`          // "HH:MM"
+	End      string   `json:"end"`            // "HH:MM"
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// compiledWindow is a SendWindow with its timezone and times resolved.
+type compiledWindow struct {
+	loc        *time.Location
+	days       map[time.Weekday]bool // nil = every day
+	start, end time.Duration         // wall-clock time of day (hours and minutes)
+}
+
+func parseClock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("%w: bad time %q (want HH:MM)", ErrInvalidCampaign, s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// clockOn is the wall-clock time of day on day's date in loc. It is built
+// with time.Date rather than by adding to midnight, so a DST change earlier in
+// the day does not shift it by an hour.
+func clockOn(day time.Time, clock time.Duration, loc *time.Location) time.Time {
+	return time.Date(day.Year(), day.Month(), day.Day(), int(clock/time.Hour), int(clock%time.Hour/time.Minute), 0, 0, loc)
+}
+
+func (w *SendWindow) compile() (*compiledWindow, error) {
+	cw := &compiledWindow{loc: time.UTC}
+	if w.Timezone != "" {
+		loc, err := time.LoadLocation(w.Timezone)
+		if err != nil {
+			return nil, fmt.Errorf("%w: timezone %q: %v", ErrInvalidCampaign, w.Timezone, err)
+		}
+		cw.loc = loc
+	}
+	var err error
+	if cw.start, err = parseClock(w.Start); err != nil {
+		return nil, err
+	}
+	if cw.end, err = parseClock(w.End); err != nil {
+		return nil, err
+	}
+	if cw.start == cw.end {
+		return nil, fmt.Errorf("%w: send window start and end are equal", ErrInvalidCampaign)
+	}
+	for _, d := range w.Days {
+		wd, ok := weekdays[strings.ToLower(d)]
+		if !ok {
+			return nil, fmt.Errorf("%w: unknown day %q", ErrInvalidCampaign, d)
+		}
+		if cw.days == nil {
+			cw.days = map[time.Weekday]bool{}
+		}
+		cw.days[wd] = true
+	}
+	return cw, nil
+}
+
+// Validate checks the window can be compiled. A nil window is valid.
+func (w *SendWindow) Validate() error {
+	if w == nil {
+		return nil
+	}
+	_, err := w.compile()
+	return err
+}
+
+// bounds returns the window that opens on the given local day.
+func (cw *compiledWindow) bounds(day time.Time) (time.Time, time.Time) {
+	open := clockOn(day, cw.start, cw.loc)
+	shut := clockOn(day, cw.end, cw.loc)
+	if cw.end <= cw.start {
+		shut = clockOn(day.AddDate(0, 0, 1), cw.end, cw.loc)
+	}
+	return open, shut
+}
+
+func (cw *compiledWindow) allowed(day time.Time) bool {
+	return cw.days == nil || cw.days[day.Weekday()]
+}
+
+// Contains reports whether t falls inside an open window.
+func (cw *compiledWindow) Contains(t time.Time) bool {
+	local := t.In(cw.loc)
+	// yesterday's window may still be open if it runs past midnight
+	for _, day := range []time.Time{local.AddDate(0, 0, -1), local} {
+		if !cw.allowed(day) {
+			continue
+		}
+		open, shut := cw.bounds(day)
+		if !t.Before(open) && t.Before(shut) {
+			return true
+		}
+	}
+	return false
+}
+
+// NextOpen returns t if the window is open, otherwise when it next opens.
+func (cw *compiledWindow) NextOpen(t time.Time) time.Time {
+	if cw.Contains(t) {
+		return t
+	}
+	local := t.In(cw.loc)
+	for i := 0; i <= 7; i++ {
+		day := local.AddDate(0, 0, i)
+		if !cw.allowed(day) {
+			continue
+		}
+		if open, _ := cw.bounds(day); open.After(t) {
+			return open
+		}
+	}
+	return t // unreachable with at least one allowed day
+}
+
+// sendWindow returns the campaign's compiled window, or nil if it has none.
+// A stored window that no longer compiles (the host lost its time zone data,
+// say) is an error, and callers hold the sends rather than ignore the window.
+func (c *Controller) sendWindow(ctx context.Context, campaignID string) (*compiledWindow, error) {
+	def, err := c.campaignDef(ctx, campaignID)
+	if err != nil || def == nil || def.SendWindow == nil {
+		return nil, nil
+	}
+	return def.SendWindow.compile()
+}
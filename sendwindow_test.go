@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func mustWindow(t *testing.T, w SendWindow) *compiledWindow {
+	t.Helper()
+	cw, err := w.compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cw
+}
+
+func TestSendWindowContains(t *testing.T) {
+	berlin, _ := time.LoadLocation("Europe/Berlin")
+	office := mustWindow(t, SendWindow{Timezone: "Europe/Berlin", Days: []string{"mon", "tue", "wed", "thu", "fri"}, Start: "09:00", End: "18:00"})
+	daily := mustWindow(t, SendWindow{Timezone: "Europe/Berlin", Start: "09:00", End: "18:00"})
+	night := mustWindow(t, SendWindow{Start: "22:00", End: "06:00"})
+
+	tests := []struct {
+		name string
+		cw   *compiledWindow
+		at   time.Time
+		want bool
+	}{
+		{"weekday inside", office, time.Date(2026, 10, 16, 9, 0, 0, 0, berlin), true},
+		{"weekday before", office, time.Date(2026, 10, 16, 8, 59, 0, 0, berlin), false},
+		{"end is exclusive", office, time.Date(2026, 10, 16, 18, 0, 0, 0, berlin), false},
+		{"weekend", office, time.Date(2026, 10, 17, 12, 0, 0, 0, berlin), false},
+		{"other zone, same instant", office, time.Date(2026, 10, 16, 7, 30, 0, 0, time.UTC), true},
+		// DST starts 2026-03-29 (CEST, UTC+2) and ends 2026-10-25 (CET, UTC+1)
+		{"spring forward opens at 09:00 CEST", daily, time.Date(2026, 3, 29, 7, 0, 0, 0, time.UTC), true},
+		{"spring forward not at 08:00 CEST", daily, time.Date(2026, 3, 29, 6, 30, 0, 0, time.UTC), false},
+		{"spring forward shuts at 18:00 CEST", daily, time.Date(2026, 3, 29, 16, 0, 0, 0, time.UTC), false},
+		{"fall back opens at 09:00 CET", daily, time.Date(2026, 10, 25, 8, 0, 0, 0, time.UTC), true},
+		{"fall back not at 08:00 CET", daily, time.Date(2026, 10, 25, 7, 30, 0, 0, time.UTC), false},
+		{"fall back still open at 17:30 CET", daily, time.Date(2026, 10, 25, 16, 30, 0, 0, time.UTC), true},
+		{"overnight before midnight", night, time.Date(2026, 10, 16, 23, 0, 0, 0, time.UTC), true},
+		{"overnight after midnight", night, time.Date(2026, 10, 17, 5, 59, 0, 0, time.UTC), true},
+		{"overnight daytime", night, time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.cw.Contains(tt.at); got != tt.want {
+				t.Fatalf("Contains(%s) = %v, want %v", tt.at, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSendWindowNextOpen(t *testing.T) {
+	berlin, _ := time.LoadLocation("Europe/Berlin")
+	office := mustWindow(t, SendWindow{Timezone: "Europe/Berlin", Days: []string{"mon", "tue", "wed", "thu", "fri"}, Start: "09:00", End: "18:00"})
+	daily := mustWindow(t, SendWindow{Timezone: "Europe/Berlin", Start: "09:00", End: "18:00"})
+
+	tests := []struct {
+		name     string
+		cw       *compiledWindow
+		at, want time.Time
+	}{
+		{"open now", office, time.Date(2026, 10, 16, 10, 0, 0, 0, berlin), time.Date(2026, 10, 16, 10, 0, 0, 0, berlin)},
+		{"later today", office, time.Date(2026, 10, 16, 7, 0, 0, 0, berlin), time.Date(2026, 10, 16, 9, 0, 0, 0, berlin)},
+		{"friday evening to monday", office, time.Date(2026, 10, 16, 19, 0, 0, 0, berlin), time.Date(2026, 10, 19, 9, 0, 0, 0, berlin)},
+		{"across spring forward", daily, time.Date(2026, 3, 28, 19, 0, 0, 0, berlin), time.Date(2026, 3, 29, 7, 0, 0, 0, time.UTC)},
+		{"across fall back", daily, time.Date(2026, 10, 24, 19, 0, 0, 0, berlin), time.Date(2026, 10, 25, 8, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.cw.NextOpen(tt.at); !got.Equal(tt.want) {
+				t.Fatalf("NextOpen(%s) = %s, want %s", tt.at, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSendWindowValidate(t *testing.T) {
+	for _, w := range []SendWindow{
+		{Start: "9am", End: "18:00"},
+		{Start: "09:00", End: "09:00"},
+		{Timezone: "Mars/Olympus", Start: "09:00", End: "18:00"},
+		{Days: []string{"someday"}, Start: "09:00", End: "18:00"},
+	} {
+		if err := w.Validate(); !errors.Is(err, ErrInvalidCampaign) {
+			t.Errorf("%+v: err = %v, want ErrInvalidCampaign", w, err)
+		}
+	}
+}
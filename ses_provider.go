@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/service/sesv2"
+	sestypes "github.com/aws/aws-sdk-go-v2/service/sesv2/types"
+	"github.com/aws/smithy-go"
+)
+
+// sesBulkMax is how many destinations one SendBulkEmail call may carry.
+const sesBulkMax = 50
+
+// Amazon SES (v2 API) provider. It shares LoadAWSConfig with the S3 client,
+// so credentials, region and AWS_ENDPOINT (LocalStack) work the same way.
+type SESProvider struct {
+	client    *sesv2.Client
+	configSet string // SES_CONFIGURATION_SET, for event publishing; optional
+}
+
+func NewSESProvider(cfg aws.Config) *SESProvider {
+	endpoint := os.Getenv("SES_ENDPOINT")
+	return &SESProvider{
+		client: sesv2.NewFromConfig(cfg, func(o *sesv2.Options) {
+			if endpoint != "" {
+				o.BaseEndpoint = aws.String(endpoint)
+			}
+		}),
+		configSet: os.Getenv("SES_CONFIGURATION_SET"),
+	}
+}
+
+func (s *SESProvider) Name() string  { return "ses" }
+func (s *SESProvider) MaxBatch() int { return sesBulkMax }
+
+func (s *SESProvider) Send(ctx context.Context, msg *Message) error {
+	if err := msg.Validate(); err != nil {
+		return permanentError(s.Name(), err)
+	}
+
+	in := &sesv2.SendEmailInput{
+		FromEmailAddress: aws.String(msg.From.String()),
+		Destination:      sesDestination(msg),
+		Content:          &sestypes.EmailContent{Simple: sesMessage(msg)},
+		EmailTags:        sesTags(msg.Tags),
+	}
+	if msg.ReplyTo != nil {
+		in.ReplyToAddresses = []string{msg.ReplyTo.String()}
+	}
+	if s.configSet != "" {
+		in.ConfigurationSetName = aws.String(s.configSet)
+	}
+
+	if _, err := s.client.SendEmail(ctx, in); err != nil {
+		return s.classify(err)
+	}
+	return nil
+}
+
+// SendBatch sends already-rendered messages with SendBulkEmail, up to 50 per
+// call: the subject and bodies travel as replacement data for an inline
+// template of "{{{subject}}}", "{{{text}}}" and "{{{html}}}". Messages that
+// cannot share one call (different sender or reply-to, attachments) go one by
+// one through Send. errs[i] is the result for msgs[i].
+func (s *SESProvider) SendBatch(ctx context.Context, msgs []*Message) []error {
+	errs := make([]error, len(msgs))
+	var bulk []int
+	for i, msg := range msgs {
+		if err := msg.Validate(); err != nil {
+			errs[i] = permanentError(s.Name(), err)
+		} else if len(msg.Attachments) > 0 || (len(bulk) > 0 && !sesBulkCompatible(msgs[bulk[0]], msg)) {
+			errs[i] = s.Send(ctx, msg)
+		} else {
+			bulk = append(bulk, i)
+		}
+	}
+	for len(bulk) > 0 {
+		n := len(bulk)
+		if n > sesBulkMax {
+			n = sesBulkMax
+		}
+		s.sendBulk(ctx, msgs, bulk[:n], errs)
+		bulk = bulk[n:]
+	}
+	return errs
+}
+
+func (s *SESProvider) sendBulk(ctx context.Context, msgs []*Message, idx []int, errs []error) {
+	first := msgs[idx[0]]
+	content := &sestypes.EmailTemplateContent{Subject: aws.String("{{{subject}}}")}
+	if first.Text != "" {
+		content.Text = aws.String("{{{text}}}")
+	}
+	if first.HTML != "" {
+		content.Html = aws.String("{{{html}}}")
+	}
+
+	in := &sesv2.SendBulkEmailInput{
+		FromEmailAddress: aws.String(first.From.String()),
+		DefaultContent: &sestypes.BulkEmailContent{Template: &sestypes.Template{
+			TemplateContent: content,
+			TemplateData:    aws.String("{}"),
+		}},
+	}
+	if first.ReplyTo != nil {
+		in.ReplyToAddresses = []string{first.ReplyTo.String()}
+	}
+	if s.configSet != "" {
+		in.ConfigurationSetName = aws.String(s.configSet)
+	}
+	for _, i := range idx {
+		msg := msgs[i]
+		data, _ := json.Marshal(map[string]string{"subject": msg.Subject, "text": msg.Text, "html": msg.HTML})
+		in.BulkEmailEntries = append(in.BulkEmailEntries, sestypes.BulkEmailEntry{
+			Destination: sesDestination(msg),
+			ReplacementEmailContent: &sestypes.ReplacementEmailContent{
+				ReplacementTemplate: &sestypes.ReplacementTemplate{ReplacementTemplateData: aws.String(string(data))},
+			},
+			ReplacementHeaders: sesHeaders(msg.Headers),
+			ReplacementTags:    sesTags(msg.Tags),
+		})
+	}
+
+	out, err := s.client.SendBulkEmail(ctx, in)
+	if err != nil {
+		err = s.classify(err)
+		for _, i := range idx {
+			errs[i] = err
+		}
+		return
+	}
+	for n, i := range idx {
+		if n >= len(out.BulkEmailEntryResults) {
+			errs[i] = &ProviderError{Provider: s.Name(), Class: ErrClassTransient, Message: "no result for bulk entry"}
+			continue
+		}
+		errs[i] = s.bulkResult(out.BulkEmailEntryResults[n])
+	}
+}
+
+// sesBulkCompatible reports whether b can go in the same SendBulkEmail call as a.
+func sesBulkCompatible(a, b *Message) bool {
+	return a.From == b.From && (a.Text != "") == (b.Text != "") && (a.HTML != "") == (b.HTML != "") &&
+		(a.ReplyTo == nil) == (b.ReplyTo == nil) && (a.ReplyTo == nil || *a.ReplyTo == *b.ReplyTo)
+}
+
+func (s *SESProvider) bulkResult(r sestypes.BulkEmailEntryResult) error {
+	e := &ProviderError{Provider: s.Name(), Message: string(r.Status)}
+	if r.Error != nil {
+		e.Message += ": " + *r.Error
+	}
+	switch r.Status {
+	case sestypes.BulkEmailStatusSuccess:
+		return nil
+	case sestypes.BulkEmailStatusAccountThrottled, sestypes.BulkEmailStatusAccountDailyQuotaExceeded:
+		e.Class = ErrClassThrottled
+	case sestypes.BulkEmailStatusTransientFailure:
+		e.Class = ErrClassTransient
+	case sestypes.BulkEmailStatusAccountSuspended, sestypes.BulkEmailStatusAccountSendingPaused,
+		sestypes.BulkEmailStatusConfigurationSetSendingPaused, sestypes.BulkEmailStatusConfigurationSetNotFound,
+		sestypes.BulkEmailStatusMailFromDomainNotVerified:
+		// account / setup problems: pause until someone fixes them
+		e.Class = ErrClassAuth
+	default:
+		e.Class = ErrClassPermanent
+	}
+	return e
+}
+
+// classify maps SES API errors onto ProviderError classes; errors that never
+// reached SES (network, context) are left for errorClass.
+func (s *SESProvider) classify(err error) error {
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) {
+		return err
+	}
+	e := &ProviderError{Provider: s.Name(), Message: apiErr.ErrorCode() + ": " + apiErr.ErrorMessage()}
+	var respErr *awshttp.ResponseError
+	if errors.As(err, &respErr) {
+		e.StatusCode = respErr.HTTPStatusCode()
+		e.RetryAfter = parseRetryAfter(respErr.Response.Header.Get("Retry-After"), time.Now())
+	}
+	switch apiErr.ErrorCode() {
+	case "TooManyRequestsException", "ThrottlingException", "Throttling", "LimitExceededException":
+		e.Class = ErrClassThrottled
+	case "AccessDeniedException", "UnrecognizedClientException", "InvalidClientTokenId",
+		"SignatureDoesNotMatch", "ExpiredToken", "ExpiredTokenException",
+		"AccountSuspendedException", "SendingPausedException", "MailFromDomainNotVerifiedException":
+		e.Class = ErrClassAuth
+	case "MessageRejected", "BadRequestException", "NotFoundException":
+		e.Class = ErrClassPermanent
+	default:
+		switch code := e.StatusCode; {
+		case code == 401 || code == 403:
+			e.Class = ErrClassAuth
+		case code == 429:
+			e.Class = ErrClassThrottled
+		case code >= 400 && code < 500 && code != 408:
+			e.Class = ErrClassPermanent
+		default:
+			e.Class = ErrClassTransient
+		}
+	}
+	return e
+}
+
+func sesDestination(msg *Message) *sestypes.Destination {
+	return &sestypes.Destination{
+		ToAddresses:  sesAddrs(msg.To),
+		CcAddresses:  sesAddrs(msg.Cc),
+		BccAddresses: sesAddrs(msg.Bcc),
+	}
+}
+
+func sesMessage(msg *Message) *sestypes.Message {
+	m := &sestypes.Message{
+		Subject: &sestypes.Content{Data: aws.String(msg.Subject), Charset: aws.String("UTF-8")},
+		Body:    &sestypes.Body{},
+		Headers: sesHeaders(msg.Headers),
+	}
+	if msg.Text != "" {
+		m.Body.Text = &sestypes.Content{Data: aws.String(msg.Text), Charset: aws.String("UTF-8")}
+	}
+	if msg.HTML != "" {
+		m.Body.Html = &sestypes.Content{Data: aws.String(msg.HTML), Charset: aws.String("UTF-8")}
+	}
+	for _, a := range msg.Attachments {
+		att := sestypes.Attachment{
+			FileName:           aws.String(a.Filename),
+			RawContent:         a.Content,
+			ContentDisposition: sestypes.AttachmentContentDispositionAttachment,
+		}
+		if a.ContentType != "" {
+			att.ContentType = aws.String(a.ContentType)
+		}
+		if a.ContentID != "" {
+			att.ContentDisposition = sestypes.AttachmentContentDispositionInline
+			att.ContentId = aws.String(a.ContentID)
+		}
+		m.Attachments = append(m.Attachments, att)
+	}
+	return m
+}
+
+func sesAddrs(as []Address) []string {
+	if len(as) == 0 {
+		return nil
+	}
+	out := make([]string, 0, len(as))
+	for _, a := range as {
+		out = append(out, a.String())
+	}
+	return out
+}
+
+func sesHeaders(h map[string]string) []sestypes.MessageHeader {
+	var out []sestypes.MessageHeader
+	for _, k := range sortedKeys(h) {
+		out = append(out, sestypes.MessageHeader{Name: aws.String(k), Value: aws.String(h[k])})
+	}
+	return out
+}
+
+// sesTagChars is what SES allows in message tag names and values.
+var sesTagChars = regexp.MustCompile(`[^A-Za-z0-9_\-.@]`)
+
+// sesTags turns message tags into SES message tags (which show up in event
+// publishing), replacing characters SES rejects with '_'.
+func sesTags(tags map[string]string) []sestypes.MessageTag {
+	var out []sestypes.MessageTag
+	for _, k := range sortedKeys(tags) {
+		v := strings.TrimSpace(tags[k])
+		if v == "" {
+			continue
+		}
+		out = append(out, sestypes.MessageTag{
+			Name:  aws.String(sesTagChars.ReplaceAllString(k, "_")),
+			Value: aws.String(sesTagChars.ReplaceAllString(v, "_")),
+		})
+	}
+	return out
+}
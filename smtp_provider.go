@@ -0,0 +1,438 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// SMTPConfig configures SMTPProvider. Zero values take the defaults noted.
+type SMTPConfig struct {
+	Host     string
+	Port     int    // default 587, or 465 with TLS "implicit"
+	Username string // empty = no AUTH
+	Password string
+	// Auth is "plain", "login" or "cram-md5"; empty picks the first of those
+	// the server offers.
+	Auth string
+	// TLS is "starttls" (required), "implicit" (TLS from the first byte, port
+	// 465), "none", or empty for STARTTLS when the server offers it.
+	TLS                string
+	InsecureSkipVerify bool
+	LocalName          string        // EHLO name; default "localhost"
+	MaxConns           int           // open connections; default 4
+	MaxPerConn         int           // messages before a connection is recycled; default 100
+	IdleTimeout        time.Duration // idle connections older than this are checked with NOOP; default 30s
+	SendTimeout        time.Duration // per message, on top of ctx; default 30s
+}
+
+// SMTPProvider sends over SMTP, keeping a pool of authenticated connections
+// and sending many messages down each one (RSET after a rejection) instead of
+// paying for the handshake, TLS and AUTH per message. When the server offers
+// PIPELINING (RFC 2920) the envelope goes out in one write.
+type SMTPProvider struct {
+	cfg    SMTPConfig
+	idle   chan *smtpConn
+	slots  chan struct{} // one token per open connection
+	closed atomic.Bool
+}
+
+type smtpConn struct {
+	conn       net.Conn
+	client     *smtp.Client
+	pipelining bool
+	sent       int
+	lastUsed   time.Time
+}
+
+func NewSMTPProvider(cfg SMTPConfig) *SMTPProvider {
+	cfg.Auth = strings.ToLower(cfg.Auth)
+	cfg.TLS = strings.ToLower(cfg.TLS)
+	if cfg.Port == 0 {
+		cfg.Port = 587
+		if cfg.TLS == "implicit" {
+			cfg.Port = 465
+		}
+	}
+	if cfg.LocalName == "" {
+		cfg.LocalName = "localhost"
+	}
+	if cfg.MaxConns <= 0 {
+		cfg.MaxConns = 4
+	}
+	if cfg.MaxPerConn <= 0 {
+		cfg.MaxPerConn = 100
+	}
+	if cfg.IdleTimeout <= 0 {
+		cfg.IdleTimeout = 30 * time.Second
+	}
+	if cfg.SendTimeout <= 0 {
+		cfg.SendTimeout = 30 * time.Second
+	}
+	return &SMTPProvider{
+		cfg:   cfg,
+		idle:  make(chan *smtpConn, cfg.MaxConns),
+		slots: make(chan struct{}, cfg.MaxConns),
+	}
+}
+
+func (s *SMTPProvider) Name() string { return "smtp" }
+
+func (s *SMTPProvider) Send(ctx context.Context, msg *Message) error {
+	if err := msg.Validate(); err != nil {
+		return permanentError(s.Name(), err)
+	}
+	body, err := buildMIME(msg, time.Now())
+	if err != nil {
+		return permanentError(s.Name(), err)
+	}
+
+	sc, err := s.get(ctx)
+	if err != nil {
+		return s.classify(err)
+	}
+	err = s.deliver(ctx, sc, msg, body)
+	s.put(sc, err)
+	return s.classify(err)
+}
+
+// Close shuts down idle connections. Connections in use are closed when they
+// are returned.
+func (s *SMTPProvider) Close() {
+	s.closed.Store(true)
+	for {
+		select {
+		case sc := <-s.idle:
+			_ = sc.client.Quit()
+			s.drop(sc)
+		default:
+			return
+		}
+	}
+}
+
+func (s *SMTPProvider) deliver(ctx context.Context, sc *smtpConn, msg *Message, body []byte) error {
+	_ = sc.conn.SetDeadline(s.deadline(ctx))
+
+	// net/smtp knows nothing of contexts: cut the connection short on cancel
+	done, exited := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(exited)
+		select {
+		case <-ctx.Done():
+			_ = sc.conn.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+	defer func() {
+		close(done)
+		<-exited
+		_ = sc.conn.SetDeadline(time.Time{})
+	}()
+
+	if sc.pipelining {
+		if err := sendEnvelope(sc.client.Text, msg.From.Email, envelopeRecipients(msg)); err != nil {
+			return err
+		}
+	} else {
+		if err := sc.client.Mail(msg.From.Email); err != nil {
+			return err
+		}
+		for _, rcpt := range envelopeRecipients(msg) {
+			if err := sc.client.Rcpt(rcpt); err != nil {
+				return err
+			}
+		}
+	}
+	w, err := sc.client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(body); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	sc.sent++
+	return nil
+}
+
+// sendEnvelope pipelines MAIL FROM and every RCPT TO, then reads the replies
+// in order. DATA is sent only once they are all accepted, so a refused
+// recipient fails the message the same way it does without pipelining.
+func sendEnvelope(text *textproto.Conn, from string, rcpts []string) error {
+	for _, addr := range append([]string{from}, rcpts...) {
+		if strings.ContainsAny(addr, "\r\n") {
+			return errors.New("smtp: A line must not contain CR or LF")
+		}
+	}
+	id := text.Next()
+	text.StartRequest(id)
+	fmt.Fprintf(text.W, "MAIL FROM:<%s>\r\n", from)
+	for _, rcpt := range rcpts {
+		fmt.Fprintf(text.W, "RCPT TO:<%s>\r\n", rcpt)
+	}
+	err := text.W.Flush()
+	text.EndRequest(id)
+	if err != nil {
+		return err
+	}
+	text.StartResponse(id)
+	defer text.EndResponse(id)
+	var first error
+	for i := 0; i <= len(rcpts); i++ {
+		expect := 25 // RCPT: 250 or 251
+		if i == 0 {
+			expect = 250
+		}
+		_, _, err := text.ReadResponse(expect)
+		var tperr *textproto.Error
+		if err != nil && !errors.As(err, &tperr) {
+			return err // the connection is gone; no more replies to read
+		}
+		if first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// deadline bounds one SMTP exchange by SendTimeout and ctx.
+func (s *SMTPProvider) deadline(ctx context.Context) time.Time {
+	deadline := time.Now().Add(s.cfg.SendTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	return deadline
+}
+
+// get hands out an idle connection, dials a new one if the pool has room, or
+// waits for one to come back.
+func (s *SMTPProvider) get(ctx context.Context) (*smtpConn, error) {
+	for {
+		select {
+		case sc := <-s.idle:
+			if s.healthy(sc) {
+				return sc, nil
+			}
+			continue
+		default:
+		}
+		select {
+		case sc := <-s.idle:
+			if s.healthy(sc) {
+				return sc, nil
+			}
+		case s.slots <- struct{}{}:
+			sc, err := s.dial(ctx)
+			if err != nil {
+				<-s.slots
+				return nil, err
+			}
+			return sc, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// healthy checks a connection that sat idle long enough for the server to
+// have dropped it; broken ones are discarded.
+func (s *SMTPProvider) healthy(sc *smtpConn) bool {
+	if time.Since(sc.lastUsed) < s.cfg.IdleTimeout {
+		return true
+	}
+	_ = sc.conn.SetDeadline(time.Now().Add(5 * time.Second))
+	err := sc.client.Noop()
+	_ = sc.conn.SetDeadline(time.Time{})
+	if err != nil {
+		s.drop(sc)
+		return false
+	}
+	return true
+}
+
+// put returns a connection to the pool. After an SMTP-level rejection the
+// session is reset and reused; after anything else (I/O error, timeout) or
+// once it has sent MaxPerConn messages it is closed.
+func (s *SMTPProvider) put(sc *smtpConn, sendErr error) {
+	var tperr *textproto.Error
+	reusable := sendErr == nil || (errors.As(sendErr, &tperr) && tperr.Code != 421)
+	if reusable && sc.sent < s.cfg.MaxPerConn && !s.closed.Load() {
+		if sendErr == nil || sc.client.Reset() == nil {
+			sc.lastUsed = time.Now()
+			s.idle <- sc
+			return
+		}
+	}
+	if reusable {
+		_ = sc.client.Quit()
+	}
+	s.drop(sc)
+}
+
+func (s *SMTPProvider) drop(sc *smtpConn) {
+	_ = sc.client.Close()
+	<-s.slots
+}
+
+func (s *SMTPProvider) dial(ctx context.Context) (*smtpConn, error) {
+	addr := net.JoinHostPort(s.cfg.Host, strconv.Itoa(s.cfg.Port))
+	tlsCfg := &tls.Config{ServerName: s.cfg.Host, InsecureSkipVerify: s.cfg.InsecureSkipVerify}
+	d := &net.Dialer{Timeout: 10 * time.Second}
+
+	var conn net.Conn
+	var err error
+	if s.cfg.TLS == "implicit" {
+		conn, err = (&tls.Dialer{NetDialer: d, Config: tlsCfg}).DialContext(ctx, "tcp", addr)
+	} else {
+		conn, err = d.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	_ = conn.SetDeadline(s.deadline(ctx))
+
+	c, err := smtp.NewClient(conn, s.cfg.Host)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	fail := func(err error) (*smtpConn, error) {
+		c.Close()
+		return nil, err
+	}
+	if err := c.Hello(s.cfg.LocalName); err != nil {
+		return fail(err)
+	}
+
+	if s.cfg.TLS != "implicit" && s.cfg.TLS != "none" {
+		if ok, _ := c.Extension("STARTTLS"); ok {
+			if err := c.StartTLS(tlsCfg); err != nil {
+				return fail(err)
+			}
+		} else if s.cfg.TLS == "starttls" {
+			// a setup problem like bad credentials: pause rather than dead-letter everything
+			return fail(&ProviderError{Provider: s.Name(), Class: ErrClassAuth, Message: "server does not offer STARTTLS"})
+		}
+	}
+	if s.cfg.Username != "" {
+		auth, err := s.auth(c)
+		if err != nil {
+			return fail(err)
+		}
+		if err := c.Auth(auth); err != nil {
+			var tperr *textproto.Error
+			if !errors.As(err, &tperr) {
+				// net/smtp refuses to send credentials in the clear, etc.
+				err = &ProviderError{Provider: s.Name(), Class: ErrClassAuth, Message: err.Error()}
+			}
+			return fail(err)
+		}
+	}
+	_ = conn.SetDeadline(time.Time{})
+	pipelining, _ := c.Extension("PIPELINING")
+	return &smtpConn{conn: conn, client: c, pipelining: pipelining, lastUsed: time.Now()}, nil
+}
+
+// auth picks the configured mechanism, or the first the server offers.
+func (s *SMTPProvider) auth(c *smtp.Client) (smtp.Auth, error) {
+	mech := s.cfg.Auth
+	if mech == "" {
+		_, offered := c.Extension("AUTH")
+		offered = strings.ToLower(offered)
+		for _, m := range []string{"plain", "login", "cram-md5"} {
+			if strings.Contains(" "+offered+" ", " "+m+" ") {
+				mech = m
+				break
+			}
+		}
+	}
+	switch mech {
+	case "plain":
+		return smtp.PlainAuth("", s.cfg.Username, s.cfg.Password, s.cfg.Host), nil
+	case "login":
+		return &loginAuth{username: s.cfg.Username, password: s.cfg.Password, host: s.cfg.Host}, nil
+	case "cram-md5":
+		return smtp.CRAMMD5Auth(s.cfg.Username, s.cfg.Password), nil
+	case "":
+		return nil, &ProviderError{Provider: s.Name(), Class: ErrClassAuth, Message: "server offers no supported AUTH mechanism"}
+	default:
+		return nil, &ProviderError{Provider: s.Name(), Class: ErrClassAuth, Message: fmt.Sprintf("unknown SMTP auth %q", mech)}
+	}
+}
+
+// classify turns SMTP replies into ProviderErrors. Network errors and
+// timeouts are left for errorClass.
+func (s *SMTPProvider) classify(err error) error {
+	var tperr *textproto.Error
+	if err == nil || !errors.As(err, &tperr) {
+		return err
+	}
+	e := &ProviderError{Provider: s.Name(), StatusCode: tperr.Code, Message: tperr.Msg}
+	switch code := tperr.Code; {
+	case code == 530 || code == 534 || code == 535 || code == 538:
+		e.Class = ErrClassAuth
+	case code == 421 || code == 450 || code == 451 || code == 452:
+		// service closing / mailbox busy / local error / out of storage:
+		// servers also use these for greylisting and rate limiting
+		if isThrottleReply(tperr.Msg) {
+			e.Class = ErrClassThrottled
+		} else {
+			e.Class = ErrClassTransient
+		}
+	case code >= 400 && code < 500:
+		e.Class = ErrClassTransient
+	default:
+		e.Class = ErrClassPermanent
+	}
+	return e
+}
+
+func isThrottleReply(msg string) bool {
+	msg = strings.ToLower(msg)
+	for _, w := range []string{"rate", "too many", "throttl", "try again later", "slow down"} {
+		if strings.Contains(msg, w) {
+			return true
+		}
+	}
+	return false
+}
+
+// loginAuth implements the (non-standard but common) AUTH LOGIN mechanism,
+// with the same refusal to send credentials unencrypted as smtp.PlainAuth.
+type loginAuth struct {
+	username, password, host string
+}
+
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS && server.Name != "localhost" && server.Name != "127.0.0.1" && server.Name != "::1" {
+		return "", nil, errors.New("unencrypted connection")
+	}
+	if server.Name != a.host {
+		return "", nil, errors.New("wrong host name")
+	}
+	return "LOGIN", nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	switch strings.ToLower(strings.TrimSpace(string(fromServer))) {
+	case "username:", "username":
+		return []byte(a.username), nil
+	case "password:", "password":
+		return []byte(a.password), nil
+	}
+	return nil, fmt.Errorf("unexpected LOGIN challenge %q", fromServer)
+}
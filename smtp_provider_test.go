@@ -0,0 +1,370 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSMTP is an in-process SMTP server, just enough of RFC 5321 for
+// SMTPProvider: EHLO, STARTTLS, AUTH PLAIN/LOGIN, PIPELINING and a few
+// canned rejections by recipient (bad@ 550, busy@ 451 rate limit, full@ 452).
+type fakeSMTP struct {
+	ln         net.Listener
+	tls        *tls.Config // nil: STARTTLS not offered
+	pipelining bool
+	user, pass string // empty: no AUTH required
+
+	mu        sync.Mutex
+	conns     int
+	quits     int
+	tlsConns  int
+	pipelined int // MAIL commands that arrived together with their RCPTs
+	mails     []fakeMail
+}
+
+type fakeMail struct {
+	from  string
+	rcpts []string
+	data  string
+}
+
+func startFakeSMTP(t *testing.T, f *fakeSMTP) *fakeSMTP {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.ln = ln
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			f.mu.Lock()
+			f.conns++
+			f.mu.Unlock()
+			go f.serve(c)
+		}
+	}()
+	return f
+}
+
+func (f *fakeSMTP) provider(cfg SMTPConfig) *SMTPProvider {
+	cfg.Host = "127.0.0.1"
+	cfg.Port = f.ln.Addr().(*net.TCPAddr).Port
+	cfg.InsecureSkipVerify = true
+	if cfg.TLS == "" {
+		cfg.TLS = "none"
+		if f.tls != nil {
+			cfg.TLS = "starttls"
+		}
+	}
+	return NewSMTPProvider(cfg)
+}
+
+func (f *fakeSMTP) serve(c net.Conn) {
+	defer c.Close()
+	tc := textproto.NewConn(c)
+	reply := func(format string, args ...any) { _ = tc.PrintfLine(format, args...) }
+	var inTLS, authed bool
+	var cur *fakeMail
+	reply("220 fake ESMTP")
+	for {
+		line, err := tc.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "EHLO":
+			ext := []string{"fake"}
+			if f.tls != nil && !inTLS {
+				ext = append(ext, "STARTTLS")
+			}
+			if f.pipelining {
+				ext = append(ext, "PIPELINING")
+			}
+			if f.user != "" {
+				ext = append(ext, "AUTH PLAIN LOGIN")
+			}
+			for i, e := range ext {
+				sep := "-"
+				if i == len(ext)-1 {
+					sep = " "
+				}
+				reply("250%s%s", sep, e)
+			}
+		case "STARTTLS":
+			reply("220 go ahead")
+			tlsConn := tls.Server(c, f.tls)
+			if tlsConn.Handshake() != nil {
+				return
+			}
+			c, tc, inTLS = tlsConn, textproto.NewConn(tlsConn), true
+			f.mu.Lock()
+			f.tlsConns++
+			f.mu.Unlock()
+		case "AUTH":
+			mech, initial, _ := strings.Cut(arg, " ")
+			var user, pass string
+			switch strings.ToUpper(mech) {
+			case "PLAIN":
+				b, _ := base64.StdEncoding.DecodeString(initial)
+				if parts := strings.Split(string(b), "\x00"); len(parts) == 3 {
+					user, pass = parts[1], parts[2]
+				}
+			case "LOGIN":
+				user, pass = f.challenge(tc, "Username:"), f.challenge(tc, "Password:")
+			}
+			if f.user != "" && user == f.user && pass == f.pass {
+				authed = true
+				reply("235 2.7.0 authenticated")
+			} else {
+				reply("535 5.7.8 authentication credentials invalid")
+			}
+		case "MAIL":
+			if f.user != "" && !authed {
+				reply("530 5.7.0 authentication required")
+				continue
+			}
+			if tc.R.Buffered() > 0 {
+				f.mu.Lock()
+				f.pipelined++
+				f.mu.Unlock()
+			}
+			cur = &fakeMail{from: strings.Trim(strings.TrimPrefix(arg, "FROM:"), "<>")}
+			reply("250 2.1.0 ok")
+		case "RCPT":
+			rcpt := strings.Trim(strings.TrimPrefix(arg, "TO:"), "<>")
+			switch {
+			case cur == nil:
+				reply("503 5.5.1 need MAIL first")
+			case strings.HasPrefix(rcpt, "bad@"):
+				reply("550 5.1.1 no such user")
+			case strings.HasPrefix(rcpt, "busy@"):
+				reply("451 4.7.1 rate limited, try again later")
+			case strings.HasPrefix(rcpt, "full@"):
+				reply("452 4.2.2 mailbox full")
+			default:
+				cur.rcpts = append(cur.rcpts, rcpt)
+				reply("250 2.1.5 ok")
+			}
+		case "DATA":
+			if cur == nil || len(cur.rcpts) == 0 {
+				reply("554 5.5.1 no valid recipients")
+				continue
+			}
+			reply("354 end with .")
+			b, err := io.ReadAll(tc.DotReader())
+			if err != nil {
+				return
+			}
+			cur.data = string(b)
+			f.mu.Lock()
+			f.mails = append(f.mails, *cur)
+			f.mu.Unlock()
+			cur = nil
+			reply("250 2.0.0 queued")
+		case "RSET":
+			cur = nil
+			reply("250 2.0.0 ok")
+		case "NOOP":
+			reply("250 2.0.0 ok")
+		case "QUIT":
+			f.mu.Lock()
+			f.quits++
+			f.mu.Unlock()
+			reply("221 2.0.0 bye")
+			return
+		default:
+			reply("502 5.5.2 unknown command")
+		}
+	}
+}
+
+func (f *fakeSMTP) challenge(tc *textproto.Conn, prompt string) string {
+	_ = tc.PrintfLine("334 %s", base64.StdEncoding.EncodeToString([]byte(prompt)))
+	line, _ := tc.ReadLine()
+	b, _ := base64.StdEncoding.DecodeString(line)
+	return string(b)
+}
+
+func (f *fakeSMTP) stats() (conns, quits, tlsConns, pipelined, mails int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.conns, f.quits, f.tlsConns, f.pipelined, len(f.mails)
+}
+
+// selfSignedTLS is a server config with a throwaway certificate for 127.0.0.1.
+func selfSignedTLS(t *testing.T) *tls.Config {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+}
+
+func smtpMessage(to string) *Message {
+	return &Message{
+		From:    Address{Email: "news@shop.example"},
+		To:      []Address{{Email: to}},
+		Bcc:     []Address{{Email: "audit@shop.example"}},
+		Subject: "hello",
+		Text:    "hi",
+	}
+}
+
+func TestSMTPProviderSTARTTLSAndAuth(t *testing.T) {
+	for _, mech := range []string{"plain", "login", ""} {
+		t.Run("auth "+mech, func(t *testing.T) {
+			f := startFakeSMTP(t, &fakeSMTP{tls: selfSignedTLS(t), user: "user", pass: "secret"})
+			p := f.provider(SMTPConfig{Username: "user", Password: "secret", Auth: mech})
+			defer p.Close()
+			if err := p.Send(context.Background(), smtpMessage("ann@x.com")); err != nil {
+				t.Fatal(err)
+			}
+			_, _, tlsConns, _, mails := f.stats()
+			if tlsConns != 1 || mails != 1 {
+				t.Fatalf("tls connections %d, mails %d; want 1 and 1", tlsConns, mails)
+			}
+			m := f.mails[0]
+			if m.from != "news@shop.example" || strings.Join(m.rcpts, ",") != "ann@x.com,audit@shop.example" {
+				t.Fatalf("envelope %s -> %v", m.from, m.rcpts)
+			}
+			if strings.Contains(m.data, "audit@") {
+				t.Fatal("Bcc leaked into the message")
+			}
+		})
+	}
+
+	t.Run("bad credentials", func(t *testing.T) {
+		f := startFakeSMTP(t, &fakeSMTP{tls: selfSignedTLS(t), user: "user", pass: "secret"})
+		err := f.provider(SMTPConfig{Username: "user", Password: "wrong"}).Send(context.Background(), smtpMessage("ann@x.com"))
+		if errorClass(err) != ErrClassAuth {
+			t.Fatalf("err = %v (%s), want auth", err, errorClass(err))
+		}
+	})
+
+	t.Run("STARTTLS required but not offered", func(t *testing.T) {
+		f := startFakeSMTP(t, &fakeSMTP{})
+		err := f.provider(SMTPConfig{TLS: "starttls"}).Send(context.Background(), smtpMessage("ann@x.com"))
+		if errorClass(err) != ErrClassAuth {
+			t.Fatalf("err = %v (%s), want auth", err, errorClass(err))
+		}
+	})
+}
+
+func TestSMTPProviderPooling(t *testing.T) {
+	f := startFakeSMTP(t, &fakeSMTP{})
+	p := f.provider(SMTPConfig{MaxConns: 2})
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := p.Send(context.Background(), smtpMessage("ann@x.com")); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if conns, _, _, _, mails := f.stats(); conns > 2 || mails != 20 {
+		t.Fatalf("%d connections for %d mails, want at most 2 for 20", conns, mails)
+	}
+	p.Close()
+	if _, quits, _, _, _ := f.stats(); quits == 0 {
+		t.Fatal("Close did not QUIT the idle connections")
+	}
+
+	t.Run("recycled after MaxPerConn", func(t *testing.T) {
+		f := startFakeSMTP(t, &fakeSMTP{})
+		p := f.provider(SMTPConfig{MaxConns: 1, MaxPerConn: 5})
+		defer p.Close()
+		for i := 0; i < 12; i++ {
+			if err := p.Send(context.Background(), smtpMessage("ann@x.com")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if conns, quits, _, _, _ := f.stats(); conns != 3 || quits != 2 {
+			t.Fatalf("%d connections, %d QUITs; want 3 and 2", conns, quits)
+		}
+	})
+}
+
+func TestSMTPProviderErrors(t *testing.T) {
+	for _, pipelining := range []bool{false, true} {
+		f := startFakeSMTP(t, &fakeSMTP{pipelining: pipelining})
+		p := f.provider(SMTPConfig{MaxConns: 1})
+		tests := []struct {
+			to    string
+			class string
+			code  int
+		}{
+			{"bad@x.com", ErrClassPermanent, 550},
+			{"busy@x.com", ErrClassThrottled, 451},
+			{"full@x.com", ErrClassTransient, 452},
+		}
+		for _, tt := range tests {
+			err := p.Send(context.Background(), smtpMessage(tt.to))
+			var pe *ProviderError
+			if !errors.As(err, &pe) || pe.Class != tt.class || pe.StatusCode != tt.code {
+				t.Errorf("pipelining=%v %s: err = %v, want %s %d", pipelining, tt.to, err, tt.class, tt.code)
+			}
+		}
+		// a rejected recipient resets the session instead of dropping it
+		if err := p.Send(context.Background(), smtpMessage("ann@x.com")); err != nil {
+			t.Fatal(err)
+		}
+		conns, _, _, pipelined, mails := f.stats()
+		if conns != 1 || mails != 1 {
+			t.Errorf("pipelining=%v: %d connections, %d mails; want 1 and 1", pipelining, conns, mails)
+		}
+		if want := map[bool]int{false: 0, true: 4}[pipelining]; pipelined != want {
+			t.Errorf("pipelining=%v: %d pipelined envelopes, want %d", pipelining, pipelined, want)
+		}
+		p.Close()
+	}
+}
+
+func TestLoginAuthChallenges(t *testing.T) {
+	a := &loginAuth{username: "user", password: "secret", host: "localhost"}
+	for challenge, want := range map[string]string{
+		"Username:": "user", "username": "user",
+		"Password:": "secret", "password": "secret",
+	} {
+		got, err := a.Next([]byte(challenge), true)
+		if err != nil || string(got) != want {
+			t.Errorf("Next(%q) = %q, %v; want %q", challenge, got, err, want)
+		}
+	}
+	if _, err := a.Next([]byte("Realm:"), true); err == nil {
+		t.Error("unknown challenge accepted")
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// QueueStore is everything the controller, workers and reconciler need from
+// a backend. RedisQueueStore is the distributed implementation;
+// MemoryQueueStore keeps everything in process (tests, single binary).
+//
+// Jobs travel as serialized JSON strings ("raw"); the raw string a worker
+// popped is the handle it uses to ack, extend or requeue that job.
+type QueueStore interface {
+	// queue + processing with leases
+	Enqueue(ctx context.Context, campaignID string, payload any) error
+	EnqueueBatch(ctx context.Context, campaignID string, payloads []any) error
+	PopToProcessing(ctx context.Context, campaignID, workerID string, lease, timeout time.Duration) (string, error) // timeout <= 0: don't wait
+	RemoveFromProcessing(ctx context.Context, campaignID, payload string) error
+	ExtendLease(ctx context.Context, campaignID, payload, workerID string, lease time.Duration) (bool, error)
+	RequeueExpired(ctx context.Context, campaignID string, lease time.Duration, max int) (int, error)
+	DrainPending(ctx context.Context, campaignID string, max int) ([]string, error)
+	HoldPending(ctx context.Context, campaignID, token string, max int) ([]string, error) // DrainPending, but kept aside under token until ReleaseHeld
+	ReleaseHeld(ctx context.Context, campaignID, token string, requeue bool) (int, error) // requeue: back to the queue; else deleted
+	HeldTokens(ctx context.Context, campaignID string) ([]string, error)                  // tokens that still hold jobs
+
+	// retries (and deferred / locally scheduled jobs), scored by unix seconds
+	AddRetry(ctx context.Context, campaignID string, unixTs int64, payload string) error
+	AddRetryBatch(ctx context.Context, campaignID string, items []retryItem) error
+	PromoteDueRetries(ctx context.Context, campaignID string, now int64, max int) (int, error)
+	Retries(ctx context.Context, campaignID string, offset, limit int) ([]retryItem, int64, error)
+
+	// dead letters: jobs that will not be retried, keyed by job ID, oldest first
+	AddDeadLetter(ctx context.Context, campaignID, jobID, payload string, at time.Time) error
+	DeadLetters(ctx context.Context, campaignID string, offset, limit int) ([]string, int64, error)
+	TakeDeadLetters(ctx context.Context, campaignID string, jobIDs []string, max int) ([]string, error)
+
+	// deliveries: the provider that accepted each recipient's message, keyed by email
+	RecordDeliveries(ctx context.Context, campaignID string, ds []Delivery) error
+	GetDelivery(ctx context.Context, campaignID, email string) (Delivery, error) // ErrNotFound until delivered
+
+	// progress counters
+	InitProgress(ctx context.Context, campaignID string, total int64) error
+	IncrProgress(ctx context.Context, campaignID, field string, delta int64) (int64, error)
+	GetProgress(ctx context.Context, campaignID string) (map[string]string, error)
+	DeleteProgress(ctx context.Context, campaignID, field string) error
+	CompleteIfDone(ctx context.Context, campaignID string, finishedAt time.Time) (bool, error)
+
+	// status
+	SetStatus(ctx context.Context, campaignID, status string) error
+	GetStatus(ctx context.Context, campaignID string) (string, error)
+	TransitionStatus(ctx context.Context, campaignID string, from []string, to string) (bool, string, error)
+
+	// rate limits
+	SetRateLimit(ctx context.Context, campaignID string, limit int64) error
+	GetRateLimit(ctx context.Context, campaignID string) (int64, error)
+	SetRateBurst(ctx context.Context, campaignID string, burst int64) error
+	GetRateBurst(ctx context.Context, campaignID string) (int64, error)
+	SetScopedLimit(ctx context.Context, scope string, limit RateLimit) error
+	DeleteScopedLimit(ctx context.Context, scope string) error
+	GetScopedLimits(ctx context.Context) (map[string]RateLimit, error)
+	TakeRate(ctx context.Context, buckets []rateBucket) (bool, time.Duration, int, error)
+	RateAvailable(ctx context.Context, scope string, limit RateLimit) (int64, error)
+	IncrRateCount(ctx context.Context, campaignID string) (int64, error) // sends admitted in the current one-minute window
+	GetRateCount(ctx context.Context, campaignID string) (int64, error)
+
+	// campaign content + definition
+	SetMessage(ctx context.Context, campaignID string, msg *Message) error
+	GetMessage(ctx context.Context, campaignID string) (*Message, error)
+	SetTemplate(ctx context.Context, campaignID string, t *Template) error
+	GetTemplate(ctx context.Context, campaignID string) (string, error)
+	SetColumns(ctx context.Context, campaignID string, columns []string) error
+	GetColumns(ctx context.Context, campaignID string) ([]string, error)
+	CreateCampaignDef(ctx context.Context, def *CampaignDef) (bool, error)
+	SaveCampaignDef(ctx context.Context, def *CampaignDef) error
+	GetCampaignDef(ctx context.Context, campaignID string) (*CampaignDef, error)
+	DeleteCampaign(ctx context.Context, campaignID string) error
+	RegisterCampaign(ctx context.Context, campaignID string)
+	ListCampaigns(ctx context.Context) ([]string, error)
+
+	// schedules + events
+	SetSchedule(ctx context.Context, campaignID string, start, stop *time.Time) error
+	DueSchedules(ctx context.Context, kind string, now time.Time) ([]string, error)
+	ClearSchedule(ctx context.Context, kind, campaignID string) error
+	PublishEvent(ctx context.Context, ev CampaignEvent) error
+}
+
+// ErrNotFound is returned by single-value getters (status, rate limit) when
+// nothing is stored.
+var ErrNotFound = errors.New("not found")
+
+func isNotFound(err error) bool { return errors.Is(err, ErrNotFound) }
+
+// retryItem is a serialized job due at unix time At.
+type retryItem struct {
+	At      int64
+	Payload string
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// testQueueStore runs the behaviour every QueueStore backend must share.
+// newStore returns a store for one subtest; campaign IDs and rate scopes are
+// random, so a shared database can be reused between runs.
+func testQueueStore(t *testing.T, newStore func(t *testing.T) QueueStore) {
+	tests := []struct {
+		name string
+		run  func(t *testing.T, s QueueStore, id string)
+	}{
+		{"pop and ack", testStorePopAndAck},
+		{"leases", testStoreLeases},
+		{"retries", testStoreRetries},
+		{"gcra", testStoreGCRA},
+		{"drain", testStoreDrain},
+		{"hold and release", testStoreHold},
+		{"completion", testStoreCompletion},
+		{"deliveries", testStoreDeliveries},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) { tt.run(t, newStore(t), "test-"+newID()) })
+	}
+}
+
+func mustPop(t *testing.T, s QueueStore, id, worker string, lease time.Duration) (string, JobPayload) {
+	t.Helper()
+	raw, err := s.PopToProcessing(context.Background(), id, worker, lease, 0)
+	if err != nil {
+		t.Fatalf("pop: %v", err)
+	}
+	var job JobPayload
+	if raw != "" {
+		if err := json.Unmarshal([]byte(raw), &job); err != nil {
+			t.Fatalf("pop returned %q: %v", raw, err)
+		}
+	}
+	return raw, job
+}
+
+func enqueueEmails(t *testing.T, s QueueStore, id string, emails ...string) {
+	t.Helper()
+	jobs := make([]any, 0, len(emails))
+	for _, e := range emails {
+		jobs = append(jobs, JobPayload{ID: newID(), Email: e})
+	}
+	if err := s.EnqueueBatch(context.Background(), id, jobs); err != nil {
+		t.Fatalf("enqueue: %v", err)
+	}
+}
+
+func testStorePopAndAck(t *testing.T, s QueueStore, id string) {
+	ctx := context.Background()
+	enqueueEmails(t, s, id, "a@x.com", "b@x.com")
+	for _, want := range []string{"a@x.com", "b@x.com"} {
+		raw, job := mustPop(t, s, id, "w1", time.Minute)
+		if job.Email != want {
+			t.Fatalf("popped %q, want %q (FIFO)", job.Email, want)
+		}
+		if err := s.RemoveFromProcessing(ctx, id, raw); err != nil {
+			t.Fatal(err)
+		}
+	}
+	start := time.Now()
+	if raw, _ := mustPop(t, s, id, "w1", time.Minute); raw != "" {
+		t.Fatalf("empty queue popped %q", raw)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("pop with timeout 0 waited %s", d)
+	}
+}
+
+func testStoreLeases(t *testing.T, s QueueStore, id string) {
+	ctx := context.Background()
+	enqueueEmails(t, s, id, "a@x.com")
+	raw, _ := mustPop(t, s, id, "w1", 200*time.Millisecond)
+
+	if ok, err := s.ExtendLease(ctx, id, raw, "w2", time.Minute); err != nil || ok {
+		t.Fatalf("another worker extended the lease: ok=%v err=%v", ok, err)
+	}
+	if ok, err := s.ExtendLease(ctx, id, raw, "w1", 300*time.Millisecond); err != nil || !ok {
+		t.Fatalf("owner could not extend: ok=%v err=%v", ok, err)
+	}
+	if n, err := s.RequeueExpired(ctx, id, 300*time.Millisecond, 10); err != nil || n != 0 {
+		t.Fatalf("requeued a live lease: n=%d err=%v", n, err)
+	}
+	time.Sleep(500 * time.Millisecond)
+	if n, err := s.RequeueExpired(ctx, id, 300*time.Millisecond, 10); err != nil || n != 1 {
+		t.Fatalf("expired lease: requeued %d, err=%v", n, err)
+	}
+	again, job := mustPop(t, s, id, "w2", time.Minute)
+	if job.Email != "a@x.com" {
+		t.Fatalf("requeued job not popped again, got %q", again)
+	}
+	if ok, _ := s.ExtendLease(ctx, id, again, "w1", time.Minute); ok {
+		t.Fatal("the old owner kept the lease after requeue")
+	}
+}
+
+func testStoreRetries(t *testing.T, s QueueStore, id string) {
+	ctx := context.Background()
+	now := time.Now().Unix()
+	due := mustJSON(JobPayload{ID: "due", Email: "due@x.com", Attempts: 1})
+	later := mustJSON(JobPayload{ID: "later", Email: "later@x.com", Attempts: 1})
+	if err := s.AddRetryBatch(ctx, id, []retryItem{{At: now + 3600, Payload: later}, {At: now - 1, Payload: due}}); err != nil {
+		t.Fatal(err)
+	}
+	items, total, err := s.Retries(ctx, id, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a backend may already count the due one as queued (Postgres)
+	if total < 1 || items[len(items)-1].Payload != later || items[len(items)-1].At != now+3600 {
+		t.Fatalf("retries: total=%d items=%+v", total, items)
+	}
+	if _, err := s.PromoteDueRetries(ctx, id, now, 10); err != nil {
+		t.Fatal(err)
+	}
+	if _, job := mustPop(t, s, id, "w1", time.Minute); job.ID != "due" {
+		t.Fatalf("popped %+v, want the due retry", job)
+	}
+	if raw, _ := mustPop(t, s, id, "w1", time.Minute); raw != "" {
+		t.Fatalf("a retry that is not due was popped: %s", raw)
+	}
+	if _, total, _ := s.Retries(ctx, id, 0, 10); total != 1 {
+		t.Fatalf("%d retries left, want 1", total)
+	}
+}
+
+func testStoreGCRA(t *testing.T, s QueueStore, id string) {
+	ctx := context.Background()
+	slow := rateBucket{Scope: "test:" + newID(), Limit: RateLimit{TPM: 60, Burst: 2}}
+	for i := 0; i < 2; i++ {
+		if ok, _, _, err := s.TakeRate(ctx, []rateBucket{slow}); err != nil || !ok {
+			t.Fatalf("send %d within burst refused (err=%v)", i+1, err)
+		}
+	}
+	ok, wait, idx, err := s.TakeRate(ctx, []rateBucket{slow})
+	if err != nil || ok || idx != 0 || wait <= 0 || wait > time.Second {
+		t.Fatalf("over burst: ok=%v wait=%s idx=%d err=%v", ok, wait, idx, err)
+	}
+
+	// all or nothing: a refusal by one bucket spends nothing from the others
+	wide := rateBucket{Scope: "test:" + newID(), Limit: RateLimit{TPM: 60, Burst: 10}}
+	narrow := rateBucket{Scope: "test:" + newID(), Limit: RateLimit{TPM: 60, Burst: 1}}
+	if ok, _, _, _ := s.TakeRate(ctx, []rateBucket{wide, narrow}); !ok {
+		t.Fatal("first send refused")
+	}
+	if ok, _, idx, _ := s.TakeRate(ctx, []rateBucket{wide, narrow}); ok || idx != 1 {
+		t.Fatalf("second send: ok=%v idx=%d, want refused by bucket 1", ok, idx)
+	}
+	if avail, _ := s.RateAvailable(ctx, wide.Scope, wide.Limit); avail != 9 {
+		t.Fatalf("wide bucket has %d available, want 9", avail)
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, err := s.IncrRateCount(ctx, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n, _ := s.GetRateCount(ctx, id); n != 3 {
+		t.Fatalf("rate count %d, want 3", n)
+	}
+}
+
+func testStoreDrain(t *testing.T, s QueueStore, id string) {
+	ctx := context.Background()
+	enqueueEmails(t, s, id, "a@x.com", "b@x.com", "c@x.com")
+	mustPop(t, s, id, "w1", time.Minute) // one in flight
+	if err := s.AddRetry(ctx, id, time.Now().Unix()+3600, mustJSON(JobPayload{ID: "r", Email: "r@x.com"})); err != nil {
+		t.Fatal(err)
+	}
+
+	var drained []string
+	for {
+		items, err := s.DrainPending(ctx, id, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		drained = append(drained, items...)
+		if len(items) < 2 {
+			break
+		}
+	}
+	if len(drained) != 4 {
+		t.Fatalf("drained %d jobs, want 4 (queued, in flight, retry)", len(drained))
+	}
+	if raw, _ := mustPop(t, s, id, "w1", time.Minute); raw != "" {
+		t.Fatalf("queue not empty after drain: %s", raw)
+	}
+	if _, total, _ := s.Retries(ctx, id, 0, 10); total != 0 {
+		t.Fatalf("%d retries left after drain", total)
+	}
+	if n, _ := s.RequeueExpired(ctx, id, 0, 10); n != 0 {
+		t.Fatalf("drained in-flight job came back: %d", n)
+	}
+}
+
+func testStoreHold(t *testing.T, s QueueStore, id string) {
+	ctx := context.Background()
+	enqueueEmails(t, s, id, "a@x.com", "b@x.com", "c@x.com")
+	held, err := s.HoldPending(ctx, id, "t1", 10)
+	if err != nil || len(held) != 3 {
+		t.Fatalf("held %d (err=%v), want 3", len(held), err)
+	}
+	if raw, _ := mustPop(t, s, id, "w1", time.Minute); raw != "" {
+		t.Fatal("held job was popped")
+	}
+	if tokens, err := s.HeldTokens(ctx, id); err != nil || len(tokens) != 1 || tokens[0] != "t1" {
+		t.Fatalf("tokens %v (err=%v), want [t1]", tokens, err)
+	}
+	if n, err := s.ReleaseHeld(ctx, id, "t2", true); err != nil || n != 0 {
+		t.Fatalf("another token released %d (err=%v)", n, err)
+	}
+	if n, err := s.ReleaseHeld(ctx, id, "t1", true); err != nil || n != 3 {
+		t.Fatalf("requeued %d (err=%v), want 3", n, err)
+	}
+	if tokens, _ := s.HeldTokens(ctx, id); len(tokens) != 0 {
+		t.Fatalf("tokens %v left after release", tokens)
+	}
+	if _, job := mustPop(t, s, id, "w1", time.Minute); job.Email == "" {
+		t.Fatal("requeued jobs cannot be popped")
+	}
+
+	if held, _ := s.HoldPending(ctx, id, "t1", 2); len(held) != 2 {
+		t.Fatalf("held %d, want 2", len(held))
+	}
+	if held, _ := s.HoldPending(ctx, id, "t2", 10); len(held) != 1 {
+		t.Fatalf("held %d, want the 1 left (in flight)", len(held))
+	}
+	if n, err := s.ReleaseHeld(ctx, id, "t1", false); err != nil || n != 2 {
+		t.Fatalf("deleted %d (err=%v), want 2", n, err)
+	}
+	if n, err := s.ReleaseHeld(ctx, id, "t2", true); err != nil || n != 1 {
+		t.Fatalf("requeued %d (err=%v), want t2's 1", n, err)
+	}
+	if items, _ := s.DrainPending(ctx, id, 10); len(items) != 1 {
+		t.Fatalf("%d jobs left after release, want 1", len(items))
+	}
+	if n, _ := s.ReleaseHeld(ctx, id, "t1", true); n != 0 {
+		t.Fatalf("released %d jobs twice", n)
+	}
+}
+
+func testStoreCompletion(t *testing.T, s QueueStore, id string) {
+	ctx := context.Background()
+	done := func() bool {
+		t.Helper()
+		ok, err := s.CompleteIfDone(ctx, id, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ok
+	}
+	if err := s.SetStatus(ctx, id, StateRunning); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.InitProgress(ctx, id, 2); err != nil {
+		t.Fatal(err)
+	}
+	enqueueEmails(t, s, id, "a@x.com")
+	raw, _ := mustPop(t, s, id, "w1", time.Minute)
+	if err := s.AddRetry(ctx, id, time.Now().Unix()+3600, mustJSON(JobPayload{ID: "r", Email: "r@x.com"})); err != nil {
+		t.Fatal(err)
+	}
+	if done() {
+		t.Fatal("completed with a job in flight")
+	}
+	_ = s.RemoveFromProcessing(ctx, id, raw)
+	_, _ = s.IncrProgress(ctx, id, "sent", 1)
+	_, _ = s.IncrProgress(ctx, id, "failed", 1)
+	if done() {
+		t.Fatal("completed with a retry pending")
+	}
+	if _, err := s.DrainPending(ctx, id, 10); err != nil {
+		t.Fatal(err)
+	}
+	if !done() {
+		t.Fatal("not completed with everything accounted for")
+	}
+	if status, _ := s.GetStatus(ctx, id); status != StateCompleted {
+		t.Fatalf("status %q, want completed", status)
+	}
+	if p, _ := s.GetProgress(ctx, id); p["finished_at"] == "" {
+		t.Fatalf("finished_at not set: %v", p)
+	}
+	if done() {
+		t.Fatal("completed twice")
+	}
+}
+
+func testStoreDeliveries(t *testing.T, s QueueStore, id string) {
+	ctx := context.Background()
+	at := time.Now().UTC().Truncate(time.Millisecond)
+	if _, err := s.GetDelivery(ctx, id, "a@x.com"); !isNotFound(err) {
+		t.Fatalf("before delivery: err=%v, want not found", err)
+	}
+	err := s.RecordDeliveries(ctx, id, []Delivery{
+		{JobID: "1", Email: "a@x.com", Provider: "ses", At: at},
+		{JobID: "2", Email: "b@x.com", Provider: "smtp", At: at},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RecordDeliveries(ctx, id, []Delivery{{JobID: "3", Email: "a@x.com", Provider: "smtp", At: at}}); err != nil {
+		t.Fatal(err)
+	}
+	for email, want := range map[string]Delivery{
+		"a@x.com": {JobID: "3", Email: "a@x.com", Provider: "smtp", At: at},
+		"b@x.com": {JobID: "2", Email: "b@x.com", Provider: "smtp", At: at},
+	} {
+		if d, err := s.GetDelivery(ctx, id, email); err != nil || d != want {
+			t.Errorf("%s: %+v err=%v, want %+v", email, d, err, want)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	htmltemplate "html/template"
+	"strings"
+	texttemplate "text/template"
+)
+
+// Missing-field policies for templates.
+const (
+	MissingFail    = "fail"    // fail the row permanently
+	MissingBlank   = "blank"   // render an empty string
+	MissingDefault = "default" // use Template.Defaults, failing if none is set
+)
+
+// Template is a per-campaign subject/body template rendered for every recipient.
+// Fields come from the CSV header row, plus "email".
+//
+//	{"subject": "Hi {{.first_name}}", "html": "<p>Hello {{.first_name}}</p>", "missing_field": "default", "defaults": {"first_name": "there"}}
+type Template struct {
+	Subject      string            `json:"subject,omitempty"`
+	Text         string            `json:"text,omitempty"`
+	HTML         string            `json:"html,omitempty"`
+	MissingField string            `json:"missing_field,omitempty"`
+	Defaults     map[string]string `json:"defaults,omitempty"`
+}
+
+type compiledTemplate struct {
+	raw      string
+	policy   string
+	defaults map[string]string
+	subject  *texttemplate.Template
+	text     *texttemplate.Template
+	html     *htmltemplate.Template
+}
+
+// Compile parses all parts of the template and validates the policy.
+func (t *Template) Compile() (*compiledTemplate, error) {
+	policy := t.MissingField
+	if policy == "" {
+		policy = MissingFail
+	}
+	missingkey := "missingkey=error"
+	switch policy {
+	case MissingFail, MissingDefault:
+	case MissingBlank:
+		missingkey = "missingkey=zero"
+	default:
+		return nil, fmt.Errorf("unknown missing_field policy %q", policy)
+	}
+
+	ct := &compiledTemplate{policy: policy, defaults: t.Defaults}
+	var err error
+	if t.Subject != "" {
+		if ct.subject, err = texttemplate.New("subject").Option(missingkey).Parse(t.Subject); err != nil {
+			return nil, fmt.Errorf("subject: %w", err)
+		}
+	}
+	if t.Text != "" {
+		if ct.text, err = texttemplate.New("text").Option(missingkey).Parse(t.Text); err != nil {
+			return nil, fmt.Errorf("text: %w", err)
+		}
+	}
+	if t.HTML != "" {
+		if ct.html, err = htmltemplate.New("html").Option(missingkey).Parse(t.HTML); err != nil {
+			return nil, fmt.Errorf("html: %w", err)
+		}
+	}
+	return ct, nil
+}
+
+// Render produces the subject and bodies for one recipient. Parts the
+// template does not define are left empty so the campaign message shows through.
+func (ct *compiledTemplate) Render(job JobPayload) (*Message, error) {
+	data := make(map[string]string, len(job.Fields)+len(ct.defaults)+1)
+	if ct.policy == MissingDefault {
+		for k, v := range ct.defaults {
+			data[k] = v
+		}
+	}
+	for k, v := range job.Fields {
+		data[k] = v
+	}
+	data["email"] = job.Email
+
+	out := &Message{}
+	var buf bytes.Buffer
+	if ct.subject != nil {
+		if err := ct.subject.Execute(&buf, data); err != nil {
+			return nil, fmt.Errorf("render subject: %w", err)
+		}
+		// headers cannot carry newlines
+		out.Subject = strings.Join(strings.Fields(buf.String()), " ")
+		buf.Reset()
+	}
+	if ct.text != nil {
+		if err := ct.text.Execute(&buf, data); err != nil {
+			return nil, fmt.Errorf("render text: %w", err)
+		}
+		out.Text = buf.String()
+		buf.Reset()
+	}
+	if ct.html != nil {
+		if err := ct.html.Execute(&buf, data); err != nil {
+			return nil, fmt.Errorf("render html: %w", err)
+		}
+		out.HTML = buf.String()
+	}
+	return out, nil
+}
+
+// campaignTemplate returns the compiled template for a campaign, or nil if it
+// has none. Compiled templates are cached until the stored JSON changes.
+func (c *Controller) campaignTemplate(ctx context.Context, campaignID string) (*compiledTemplate, error) {
+	raw, err := c.store.GetTemplate(ctx, campaignID)
+	if err != nil || raw == "" {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	cached, ok := c.templates[campaignID]
+	c.mu.Unlock()
+	if ok && cached.raw == raw {
+		return cached, nil
+	}
+
+	var t Template
+	if err := json.Unmarshal([]byte(raw), &t); err != nil {
+		return nil, err
+	}
+	ct, err := t.Compile()
+	if err != nil {
+		return nil, err
+	}
+	ct.raw = raw
+
+	c.mu.Lock()
+	c.templates[campaignID] = ct
+	c.mu.Unlock()
+	return ct, nil
+}
@@ -3,82 +3,293 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"math"
 	"time"
 )
 
 type JobPayload struct {
-	Email    string `json:"email"`
-	Attempts int    `json:"attempts"`
+	ID       string   `json:"id,omitempty"` // unique per job; keeps duplicate rows distinct in leases
+	Email    string   `json:"email"`
+	Attempts int      `json:"attempts"`
+	Message  *Message `json:"message,omitempty"` // per-recipient override of the campaign message
+
+	Fields map[string]string `json:"fields,omitempty"` // CSV columns by header name (template merge fields)
+
+	History     []Attempt  `json:"history,omitempty"` // one entry per failed attempt
+	LastError   string     `json:"last_error,omitempty"`
+	NextRetryAt *time.Time `json:"next_retry_at,omitempty"` // set while waiting in the retry set
+
+	ThrottledSince *time.Time `json:"throttled_since,omitempty"` // first throttled send, for the policy's max_throttle_wait
+}
+
+// Attempt records one failed delivery attempt.
+type Attempt struct {
+	At       time.Time `json:"at"`
+	Error    string    `json:"error"`
+	Provider string    `json:"provider,omitempty"` // the provider that refused it, when known
+}
+
+// Delivery records which provider accepted a job's message.
+type Delivery struct {
+	JobID    string    `json:"job_id"`
+	Email    string    `json:"email"`
+	Provider string    `json:"provider"`
+	At       time.Time `json:"delivered_at"`
 }
 
-func (c *Controller) workerLoop(campaignID string, wid int) {
-	for {
-		// 1) check global flag
-		if status, _ := c.store.GetStatus(context.Background(), campaignID); status == "paused" {
-			time.Sleep(500 * time.Millisecond)
+// delivered is the delivery record for the job, accepted by provider now.
+func (j *JobPayload) delivered(provider string) Delivery {
+	return Delivery{JobID: j.ID, Email: j.Email, Provider: provider, At: time.Now().UTC()}
+}
+
+// recordFailure notes err in the job's attempt history.
+func (j *JobPayload) recordFailure(err error) {
+	j.LastError = err.Error()
+	a := Attempt{At: time.Now().UTC(), Error: j.LastError}
+	var perr *ProviderError
+	if errors.As(err, &perr) {
+		a.Provider = perr.Provider
+	}
+	j.History = append(j.History, a)
+}
+
+// workerLoop runs until ctx is cancelled (StopCampaign) or the campaign
+// reaches a terminal state.
+func (c *Controller) workerLoop(ctx context.Context, campaignID string, wid int) {
+	workerID := fmt.Sprintf("%s/w%d", c.instanceID, wid)
+	for ctx.Err() == nil {
+		// 1) check global flag (paused, or not started / finished)
+		status, _ := c.store.GetStatus(ctx, campaignID)
+		if isTerminal(status) {
+			return
+		}
+		if status != StateRunning {
+			sleepCtx(ctx, 500*time.Millisecond)
+			continue
+		}
+		// outside the send window: idle like a pause, without touching status
+		cw, err := c.sendWindow(ctx, campaignID)
+		if err != nil {
+			fmt.Printf("[w%d] send window: %v; holding sends\n", wid, err)
+			sleepCtx(ctx, 30*time.Second)
 			continue
 		}
+		if cw != nil {
+			if now := time.Now(); !cw.Contains(now) {
+				wait := cw.NextOpen(now).Sub(now)
+				if wait > 30*time.Second {
+					wait = 30 * time.Second // pick up window / status changes
+				}
+				sleepCtx(ctx, wait)
+				continue
+			}
+		}
 
 		// 2) atomically move one job into processing (blocks)
-		raw, err := c.store.PopToProcessing(context.Background(), campaignID, 5*time.Second)
+		raw, err := c.store.PopToProcessing(ctx, campaignID, workerID, c.visibility, 5*time.Second)
 		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
 			fmt.Printf("[w%d] pop: %v\n", wid, err)
-			time.Sleep(200 * time.Millisecond)
+			sleepCtx(ctx, 200*time.Millisecond)
 			continue
 		}
 		if raw == "" {
-			continue // nothing right now
+			// nothing right now; maybe nothing ever again
+			if _, err := c.checkCompletion(ctx, campaignID); err != nil {
+				fmt.Printf("[w%d] completion check: %v\n", wid, err)
+			}
+			continue
 		}
 
-		var job JobPayload
-		if err := json.Unmarshal([]byte(raw), &job); err != nil {
-			_ = c.store.RemoveFromProcessing(context.Background(), campaignID, raw)
+		if bs, n := c.batchSender(ctx, campaignID); bs != nil {
+			c.handleBatch(ctx, campaignID, workerID, bs, c.claimMore(ctx, campaignID, workerID, raw, n))
 			continue
 		}
+		c.handleJob(ctx, campaignID, workerID, raw)
+	}
+}
 
-		// 3) rate limit (configurable per campaign)
-		limit, err := c.store.GetRateLimit(context.Background(), campaignID)
-		if err != nil || limit <= 0 {
-			limit = 120 // safe fallback
+// sleepCtx sleeps for d or until ctx is done.
+func sleepCtx(ctx context.Context, d time.Duration) {
+	select {
+	case <-ctx.Done():
+	case <-time.After(d):
+	}
+}
+
+// handleJob runs one claimed job to completion: rate limit, render, send, and
+// ack / retry / fail. The lease is held for the whole time.
+func (c *Controller) handleJob(ctx context.Context, campaignID, workerID, raw string) {
+	release := c.holdLeases(campaignID, workerID, raw)
+	defer release()
+
+	job, msg, ok := c.prepareJob(ctx, campaignID, workerID, raw)
+	if !ok {
+		return
+	}
+	provider, err := c.campaignProvider(ctx, campaignID)
+	if err == nil {
+		err = provider.Send(ctx, msg)
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return // interrupted by StopCampaign, not a provider failure
 		}
-		used, err := c.store.IncrRateCount(context.Background(), campaignID)
-		if err != nil {
-			// be conservative if redis hiccups
-			time.Sleep(500 * time.Millisecond)
-			// requeue job
-			_ = c.store.RemoveFromProcessing(context.Background(), campaignID, raw)
-			_ = c.store.Enqueue(context.Background(), campaignID, job)
-			continue
+		c.handleSendError(ctx, campaignID, workerID, job, err)
+		_ = c.store.RemoveFromProcessing(ctx, campaignID, raw)
+		return
+	}
+
+	// 5) success path; sent:<provider> counts who delivered it and the
+	// delivery record keeps it per recipient
+	by := deliveredBy(msg, provider)
+	_, _ = c.store.IncrProgress(ctx, campaignID, "sent", 1)
+	_, _ = c.store.IncrProgress(ctx, campaignID, "sent:"+by, 1)
+	_ = c.store.RecordDeliveries(ctx, campaignID, []Delivery{job.delivered(by)})
+	_ = c.store.RemoveFromProcessing(ctx, campaignID, raw)
+}
+
+// prepareJob takes a claimed job up to the point of sending: it waits for the
+// rate limiters and renders the message. When it returns !ok the job has
+// already been dealt with (deferred, requeued, dead-lettered, or left to the
+// reconciler because we are stopping).
+func (c *Controller) prepareJob(ctx context.Context, campaignID, workerID, raw string) (JobPayload, *Message, bool) {
+	var job JobPayload
+	if err := json.Unmarshal([]byte(raw), &job); err != nil {
+		_ = c.store.RemoveFromProcessing(ctx, campaignID, raw)
+		return job, nil, false
+	}
+
+	// 3) rate limit (global / provider / campaign / domain); sleeps exactly
+	// until a slot frees, except for throttled domains which are deferred
+	err := c.waitForRate(ctx, campaignID, job.Email)
+	var throttled *domainThrottled
+	if errors.As(err, &throttled) {
+		// not a failure: park it in the retry ZSET without spending an attempt
+		retryAt := time.Now().Add(throttled.wait + time.Second - 1).Unix()
+		_ = c.store.AddRetry(ctx, campaignID, retryAt, raw)
+		_ = c.store.RemoveFromProcessing(ctx, campaignID, raw)
+		return job, nil, false
+	}
+	if ctx.Err() != nil {
+		return job, nil, false // stopping: the lease expires and the reconciler requeues the job
+	}
+	if err != nil {
+		// be conservative if redis hiccups: requeue job
+		fmt.Printf("[%s] rate limit: %v\n", workerID, err)
+		sleepCtx(ctx, 500*time.Millisecond)
+		_ = c.store.RemoveFromProcessing(ctx, campaignID, raw)
+		_ = c.store.Enqueue(ctx, campaignID, job)
+		return job, nil, false
+	}
+
+	// 4) build email
+	base, err := c.campaignMessage(ctx, campaignID)
+	if err != nil {
+		fmt.Printf("[%s] load message: %v\n", workerID, err)
+		base = defaultMessage()
+	}
+	tpl, err := c.campaignTemplate(ctx, campaignID)
+	if err != nil {
+		fmt.Printf("[%s] load template: %v\n", workerID, err)
+		_ = c.store.RemoveFromProcessing(ctx, campaignID, raw)
+		_ = c.store.Enqueue(ctx, campaignID, job)
+		sleepCtx(ctx, 500*time.Millisecond)
+		return job, nil, false
+	}
+	msg, err := buildMessage(campaignID, base, tpl, job)
+	if err != nil {
+		// malformed content / missing merge fields never succeed on retry
+		fmt.Printf("[%s] %v\n", workerID, err)
+		job.recordFailure(err)
+		c.deadLetter(ctx, campaignID, job)
+		_ = c.store.RemoveFromProcessing(ctx, campaignID, raw)
+		return job, nil, false
+	}
+	return job, msg, true
+}
+
+// handleSendError decides what happens to a job the provider refused, by
+// error class: auth failures pause the campaign and put the job back as it
+// was; throttling waits out Retry-After without spending an attempt, for up
+// to the policy's max_throttle_wait; permanent failures are dead-lettered at
+// once; the rest follow the campaign's retry policy.
+func (c *Controller) handleSendError(ctx context.Context, campaignID, workerID string, job JobPayload, err error) {
+	class := errorClass(err)
+	policy := c.retryPolicy(ctx, campaignID)
+
+	if class == ErrClassAuth {
+		fmt.Printf("[%s] %v: pausing campaign %s\n", workerID, err, campaignID)
+		if terr := c.Transition(ctx, campaignID, StatePaused); terr == nil {
+			c.emit(ctx, EventPaused, campaignID)
 		}
-		if used > limit {
-			// push back and try later in this minute
-			_ = c.store.RemoveFromProcessing(context.Background(), campaignID, raw)
-			_ = c.store.Enqueue(context.Background(), campaignID, job)
-			time.Sleep(500 * time.Millisecond)
-			continue
+		_ = c.store.Enqueue(ctx, campaignID, job)
+		return
+	}
+	if class == ErrClassThrottled && policy.retries(class) {
+		now := time.Now()
+		if job.ThrottledSince == nil {
+			job.ThrottledSince = &now
 		}
-
-		// 4) send email
-		if err := c.provider.Send(job.Email); err != nil {
-			// retry with exponential backoff (max 3)
-			job.Attempts++
-			if job.Attempts <= 3 {
-				delay := time.Duration(math.Pow(2, float64(job.Attempts))) * time.Second
-				retryAt := time.Now().Add(delay).Unix()
-				_ = c.store.AddRetry(context.Background(), campaignID, retryAt, mustJSON(job))
-			} else {
-				_, _ = c.store.IncrProgress(context.Background(), campaignID, "failed", 1)
+		// throttled for longer than the policy allows: fall through and
+		// spend an attempt, so the job is dead-lettered in the end
+		if now.Sub(*job.ThrottledSince) < policy.maxThrottleWait {
+			wait := policy.base
+			var perr *ProviderError
+			if errors.As(err, &perr) && perr.RetryAfter > 0 {
+				wait = perr.RetryAfter
 			}
-			_ = c.store.RemoveFromProcessing(context.Background(), campaignID, raw)
-			continue
+			at := now.Add(wait)
+			job.NextRetryAt = &at
+			_ = c.store.AddRetry(ctx, campaignID, at.Add(time.Second-1).Unix(), mustJSON(job))
+			return
 		}
+	}
 
-		// 5) success path
-		_, _ = c.store.IncrProgress(context.Background(), campaignID, "sent", 1)
-		_ = c.store.RemoveFromProcessing(context.Background(), campaignID, raw)
+	job.Attempts++
+	job.recordFailure(err)
+	if at, ok := policy.next(job.Attempts, class, time.Now()); ok {
+		job.NextRetryAt = &at
+		_ = c.store.AddRetry(ctx, campaignID, at.Unix(), mustJSON(job))
+	} else {
+		job.NextRetryAt = nil
+		c.deadLetter(ctx, campaignID, job)
 	}
 }
 
 func mustJSON(v any) string { b, _ := json.Marshal(v); return string(b) }
+
+// holdLeases keeps extending the jobs' leases until the returned func is
+// called, so slow provider calls are not mistaken for dead workers. A job
+// whose lease was lost stops being extended.
+func (c *Controller) holdLeases(campaignID, workerID string, raws ...string) (release func()) {
+	done := make(chan struct{})
+	go func() {
+		t := time.NewTicker(c.visibility / 3)
+		defer t.Stop()
+		held := append([]string(nil), raws...)
+		for len(held) > 0 {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+				kept := held[:0]
+				for _, raw := range held {
+					ok, err := c.store.ExtendLease(context.Background(), campaignID, raw, workerID, c.visibility)
+					if err != nil {
+						fmt.Printf("[%s] extend lease: %v\n", workerID, err)
+					} else if !ok {
+						fmt.Printf("[%s] lease lost for job in %s\n", workerID, campaignID)
+						continue
+					}
+					kept = append(kept, raw)
+				}
+				held = kept
+			}
+		}
+	}()
+	return func() { close(done) }
+}